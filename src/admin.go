@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"sensor-exporter/config"
+	"sensor-exporter/sensor"
+)
+
+// authorizeAdmin checks a request to an admin endpoint, which must be a POST
+// with admin_token as a bearer token, and answers it if it is refused. The
+// endpoints are disabled unless admin_token is set.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := getConf().AdminToken
+	if token == "" {
+		http.Error(w, "admin endpoints are disabled, set admin_token to enable them", http.StatusNotFound)
+		return false
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+		http.Error(w, "invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// sensorCommandHandler serves POST /-/sensors/<instance>/<command>, which
+// runs an administrative command of a running sensor. Besides the admin
+// token it requires confirm=yes, since the commands change the state of the
+// sensor.
+func sensorCommandHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/-/sensors/"), "/")
+	if len(path) != 2 {
+		http.Error(w, "expected /-/sensors/<instance>/<command>", http.StatusNotFound)
+		return
+	}
+	var p *poller
+	for _, candidate := range getPollers() {
+		if candidate.sensor.GetInstanceName() == path[0] {
+			p = candidate
+		}
+	}
+	if p == nil {
+		http.Error(w, fmt.Sprintf("unknown sensor %q", path[0]), http.StatusNotFound)
+		return
+	}
+	cmd, err := sensor.LookupCommand(p.sensor, path[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.FormValue("confirm") != "yes" {
+		http.Error(w, fmt.Sprintf("%s %s: %s, repeat with confirm=yes", path[0], cmd.Name, cmd.Confirm), http.StatusPreconditionFailed)
+		return
+	}
+	if err := p.command(cmd, r.Form["arg"]); err != nil {
+		if err == errNotInitialized {
+			http.Error(w, fmt.Sprintf("%s is not initialized", path[0]), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, fmt.Sprintf("%s %s: %v", path[0], cmd.Name, err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%s %s done\n", path[0], cmd.Name)
+}
+
+// runSensorCommand implements "sensor-exporter <driver> <command> [args]".
+// It asks the running exporter to run the command, since the exporter holds
+// the device, and returns the exit status.
+func runSensorCommand(driver string, args []string) int {
+	fs := flag.NewFlagSet(driver, flag.ExitOnError)
+	path := fs.String("config", "/etc/sensor-exporter/sensor-exporter.conf", "config file")
+	name := fs.String("sensor", driver, "sensor section, e.g. "+driver+".outdoor")
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	fs.Parse(args)
+
+	c, err := config.Load(*path)
+	if err != nil {
+		fmt.Printf("%s: %v\n", *path, err)
+		return 1
+	}
+	config.Set(c)
+	if config.SensorType(*name) != driver {
+		fmt.Printf("%s is not a %s sensor\n", *name, driver)
+		return 2
+	}
+	s, err := sensor.New(*name)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Printf("usage: sensor-exporter %s [flags] <command> [args]\n", driver)
+		if commander, ok := s.(sensor.Commander); ok {
+			fmt.Println("commands:")
+			for _, cmd := range commander.Commands() {
+				fmt.Printf("    %-28s %s\n", strings.TrimSpace(cmd.Name+" "+cmd.Args), cmd.Help)
+			}
+		}
+		fmt.Println("flags:")
+		fs.PrintDefaults()
+		return 2
+	}
+	cmd, err := sensor.LookupCommand(s, fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	if !*yes {
+		fmt.Printf("%s %s: %s.\nContinue? [y/N] ", *name, cmd.Name, cmd.Confirm)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("aborted")
+			return 1
+		}
+	}
+
+	if err := postSensorCommand(c.Default, *name, cmd.Name, fs.Args()[1:]); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func postSensorCommand(d config.Default, name, cmd string, args []string) error {
+	if d.AdminToken == "" {
+		return errors.New("admin_token is not set in the config")
+	}
+	host := d.BindIp
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	form := url.Values{"confirm": {"yes"}, "arg": args}
+	endpoint := "http://" + net.JoinHostPort(host, d.BindPort) + "/-/sensors/" + url.PathEscape(name) + "/" + url.PathEscape(cmd)
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+d.AdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	fmt.Print(string(body))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return nil
+}
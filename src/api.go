@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+	"sensor-exporter/output/history"
+)
+
+type apiSensor struct {
+	Instance    string       `json:"instance"`
+	Name        string       `json:"name"`
+	Driver      string       `json:"driver"`
+	Up          bool         `json:"up"`
+	Error       string       `json:"error,omitempty"`
+	LastSuccess *time.Time   `json:"last_success,omitempty"`
+	Metrics     []string     `json:"metrics"`
+	Readings    []apiReading `json:"readings,omitempty"`
+}
+
+type apiReading struct {
+	Sensor     string    `json:"sensor"`
+	SensorName string    `json:"sensor_name"`
+	Metric     string    `json:"metric"`
+	Value      float64   `json:"value"`
+	Unit       string    `json:"unit"`
+	Timestamp  time.Time `json:"timestamp"`
+	Up         bool      `json:"up"`
+}
+
+// apiSensorOf returns the sensor of p and, if withReadings, its last
+// reading. Stale readings are left out like on /metrics.
+func apiSensorOf(p *poller, withReadings bool) apiSensor {
+	if getConf().ExporterMode == "collect" {
+		// the sensors are only read on request in collect mode
+		p.cachedReading(getConf().CollectMaxAge)
+	}
+	st := p.status()
+	desc := p.pipeline.Describe(p.sensor.GetMetricsDescriptions())
+	s := apiSensor{
+		Instance: p.sensor.GetInstanceName(),
+		Name:     p.sensor.GetSensorName(),
+		Driver:   config.SensorType(p.sensor.GetInstanceName()),
+		Up:       st.initialized && st.err == nil,
+		Metrics:  []string{},
+	}
+	if st.err != nil {
+		s.Error = st.err.Error()
+	}
+	if st.reading != nil {
+		lastSuccess := st.lastSuccess
+		s.LastSuccess = &lastSuccess
+	}
+	for metrics := range desc {
+		s.Metrics = append(s.Metrics, metrics)
+	}
+	sort.Strings(s.Metrics)
+
+	if !withReadings || st.reading == nil || st.stale {
+		return s
+	}
+	for _, metrics := range s.Metrics {
+		value, ok := st.reading[metrics]
+		if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		s.Readings = append(s.Readings, apiReading{
+			Sensor:     s.Instance,
+			SensorName: s.Name,
+			Metric:     metrics,
+			Value:      value,
+			Unit:       output.Unit(desc[metrics]),
+			Timestamp:  st.readAt,
+			Up:         s.Up,
+		})
+	}
+	return s
+}
+
+// apiSensorsHandler serves GET /api/v1/sensors and
+// /api/v1/sensors/<instance>, which includes the readings of the sensor.
+func apiSensorsHandler(w http.ResponseWriter, r *http.Request) {
+	if !apiMethodAllowed(w, r) {
+		return
+	}
+	instance := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/sensors"), "/")
+	if instance == "" {
+		list := []apiSensor{}
+		for _, p := range getPollers() {
+			list = append(list, apiSensorOf(p, false))
+		}
+		writeJSON(w, list)
+		return
+	}
+	for _, p := range getPollers() {
+		if p.sensor.GetInstanceName() == instance {
+			writeJSON(w, apiSensorOf(p, true))
+			return
+		}
+	}
+	http.Error(w, "unknown sensor "+instance, http.StatusNotFound)
+}
+
+// apiReadingsHandler serves GET /api/v1/readings, the last reading of every
+// sensor.
+func apiReadingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !apiMethodAllowed(w, r) {
+		return
+	}
+	list := []apiReading{}
+	for _, p := range getPollers() {
+		list = append(list, apiSensorOf(p, true).Readings...)
+	}
+	writeJSON(w, list)
+}
+
+func apiMethodAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+type apiHistorySeries struct {
+	Sensor  string   `json:"sensor"`
+	Metrics []string `json:"metrics"`
+}
+
+type apiHistory struct {
+	Sensor  string             `json:"sensor"`
+	Metric  string             `json:"metric"`
+	Start   time.Time          `json:"start"`
+	End     time.Time          `json:"end"`
+	Step    string             `json:"step,omitempty"`
+	Points  []apiHistoryPoint  `json:"points,omitempty"`
+	Buckets []apiHistoryBucket `json:"buckets,omitempty"`
+}
+
+type apiHistoryPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+type apiHistoryBucket struct {
+	Timestamp time.Time `json:"timestamp"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Avg       float64   `json:"avg"`
+	Count     uint64    `json:"count"`
+}
+
+// apiHistoryHandler serves GET /api/v1/history, the sensors and metrics
+// with a history, and /api/v1/history/<instance>/<metrics>?start=&end=&step=
+// with the raw readings from start to end, or min, max and avg per step.
+func apiHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if !apiMethodAllowed(w, r) {
+		return
+	}
+	store := history.Current()
+	if store == nil {
+		http.Error(w, "the history output is not enabled", http.StatusNotFound)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/history"), "/")
+	if path == "" {
+		series, err := store.Series()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list := []apiHistorySeries{}
+		for sensor, metrics := range series {
+			sort.Strings(metrics)
+			list = append(list, apiHistorySeries{Sensor: sensor, Metrics: metrics})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Sensor < list[j].Sensor })
+		writeJSON(w, list)
+		return
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		http.Error(w, "use /api/v1/history/<sensor>/<metrics>", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	q := r.URL.Query()
+	end, err := parseHistoryTime(q.Get("end"), now, now)
+	if err != nil {
+		http.Error(w, "end: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, err := parseHistoryTime(q.Get("start"), end.Add(-time.Hour), now)
+	if err != nil {
+		http.Error(w, "start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if s := q.Get("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil || step <= 0 {
+			http.Error(w, "step: "+s+" is not a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	maxPoints := config.GetConfig().History.MaxPoints
+	res := apiHistory{Sensor: parts[0], Metric: parts[1], Start: start, End: end}
+	if step == 0 {
+		points, err := store.Points(res.Sensor, res.Metric, start, end, maxPoints+1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(points) > maxPoints {
+			http.Error(w, "too many points, query a shorter range or use step", http.StatusBadRequest)
+			return
+		}
+		res.Points = []apiHistoryPoint{}
+		for _, p := range points {
+			res.Points = append(res.Points, apiHistoryPoint{Timestamp: p.Time, Value: p.Value})
+		}
+		writeJSON(w, res)
+		return
+	}
+	if int64(end.Sub(start)/step) > int64(maxPoints) {
+		http.Error(w, "too many buckets, use a larger step", http.StatusBadRequest)
+		return
+	}
+	buckets, used, err := store.Buckets(res.Sensor, res.Metric, start, end, step, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Step = used.String()
+	res.Buckets = []apiHistoryBucket{}
+	for _, b := range buckets {
+		res.Buckets = append(res.Buckets, apiHistoryBucket{
+			Timestamp: b.Time,
+			Min:       b.Min,
+			Max:       b.Max,
+			Avg:       b.Sum / float64(b.Count),
+			Count:     b.Count,
+		})
+	}
+	writeJSON(w, res)
+}
+
+// parseHistoryTime parses an RFC 3339 time, a unix timestamp in seconds or
+// a duration relative to now such as -6h, returning def if s is empty.
+func parseHistoryTime(s string, def, now time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(f*float64(time.Second))), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time, unix timestamp or duration", s)
+}
@@ -0,0 +1,63 @@
+package i2c
+
+import (
+	"sync"
+
+	exp "golang.org/x/exp/io/i2c"
+)
+
+// Device is a register based I2C device as seen by the sensor drivers.
+type Device interface {
+	ReadReg(reg byte, buf []byte) error
+	WriteReg(reg byte, buf []byte) error
+	Close() error
+}
+
+// Bus opens devices on a single I2C bus.
+type Bus interface {
+	Open(addr int) (Device, error)
+}
+
+// Devfs is a bus backed by a /dev/i2c-N character device.
+type Devfs struct {
+	Dev string
+}
+
+func (d *Devfs) Open(addr int) (Device, error) {
+	return exp.Open(&exp.Devfs{Dev: d.Dev}, addr)
+}
+
+var (
+	busesMu sync.Mutex
+	buses   = map[string]Bus{}
+)
+
+// Register makes bus available under name, so that drivers configured with
+// i2c_device = name use it instead of the devfs device with the same path.
+func Register(name string, bus Bus) {
+	busesMu.Lock()
+	defer busesMu.Unlock()
+	buses[name] = bus
+}
+
+// Unregister removes a bus added by Register.
+func Unregister(name string) {
+	busesMu.Lock()
+	defer busesMu.Unlock()
+	delete(buses, name)
+}
+
+// Lookup returns the registered bus for name, or a devfs bus for the path.
+func Lookup(name string) Bus {
+	busesMu.Lock()
+	defer busesMu.Unlock()
+	if bus, ok := buses[name]; ok {
+		return bus
+	}
+	return &Devfs{Dev: name}
+}
+
+// Open opens the device at addr on the bus named by name.
+func Open(name string, addr int) (Device, error) {
+	return Lookup(name).Open(addr)
+}
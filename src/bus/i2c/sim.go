@@ -0,0 +1,253 @@
+package i2c
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SimBus is an in-memory bus whose devices are register maps that can be
+// scripted by the caller. It is meant for running drivers without hardware.
+type SimBus struct {
+	mu      sync.Mutex
+	devices map[int]*SimDevice
+}
+
+func NewSimBus() *SimBus {
+	return &SimBus{devices: map[int]*SimDevice{}}
+}
+
+// AddDevice attaches an empty device at addr, replacing any existing one.
+func (b *SimBus) AddDevice(addr int) *SimDevice {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d := &SimDevice{
+		mailbox:  map[byte][]byte{},
+		readErr:  map[byte]error{},
+		writeErr: map[byte]error{},
+		onRead:   map[byte]func(*SimDevice){},
+		onWrite:  map[byte]func(*SimDevice, []byte){},
+	}
+	b.devices[addr] = d
+	return d
+}
+
+// RemoveDevice detaches the device at addr, as if it had been unplugged.
+func (b *SimBus) RemoveDevice(addr int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.devices, addr)
+}
+
+func (b *SimBus) Device(addr int) *SimDevice {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.devices[addr]
+}
+
+func (b *SimBus) Open(addr int) (Device, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d, ok := b.devices[addr]
+	if !ok {
+		return nil, fmt.Errorf("i2c: no device at address 0x%02x", addr)
+	}
+	d.mu.Lock()
+	d.opened++
+	d.mu.Unlock()
+	return &simHandle{dev: d}, nil
+}
+
+// SimWrite records a single WriteReg call on a SimDevice.
+type SimWrite struct {
+	Reg  byte
+	Data []byte
+}
+
+// SimDevice is an auto-incrementing register file. Registers set with
+// SetMailbox instead return their whole content on a read starting there,
+// like the multi-byte mailboxes of the CCS811.
+type SimDevice struct {
+	mu       sync.Mutex
+	regs     [256]byte
+	mailbox  map[byte][]byte
+	fault    error
+	readErr  map[byte]error
+	writeErr map[byte]error
+	onRead   map[byte]func(*SimDevice)
+	onWrite  map[byte]func(*SimDevice, []byte)
+	writes   []SimWrite
+	opened   int
+	closed   int
+}
+
+// Set stores data in the registers starting at reg.
+func (d *SimDevice) Set(reg byte, data ...byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.write(reg, data)
+}
+
+// SetMailbox makes reads starting at reg return data, independent of the
+// registers that follow reg. A nil data removes the mailbox.
+func (d *SimDevice) SetMailbox(reg byte, data ...byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if data == nil {
+		delete(d.mailbox, reg)
+		return
+	}
+	d.mailbox[reg] = append([]byte{}, data...)
+}
+
+// Get returns n bytes starting at reg, as ReadReg would.
+func (d *SimDevice) Get(reg byte, n int) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	buf := make([]byte, n)
+	d.read(reg, buf)
+	return buf
+}
+
+// SetFault makes every read and write fail with err. A nil err clears it.
+func (d *SimDevice) SetFault(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fault = err
+}
+
+// FailRead makes reads starting at reg fail with err. A nil err clears it.
+func (d *SimDevice) FailRead(reg byte, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		delete(d.readErr, reg)
+		return
+	}
+	d.readErr[reg] = err
+}
+
+// FailWrite makes writes to reg fail with err. A nil err clears it.
+func (d *SimDevice) FailWrite(reg byte, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		delete(d.writeErr, reg)
+		return
+	}
+	d.writeErr[reg] = err
+}
+
+// OnRead registers fn to be called before every read starting at reg.
+func (d *SimDevice) OnRead(reg byte, fn func(d *SimDevice)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onRead[reg] = fn
+}
+
+// OnWrite registers fn to be called after every write to reg. The written
+// data has already been stored when fn runs.
+func (d *SimDevice) OnWrite(reg byte, fn func(d *SimDevice, data []byte)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onWrite[reg] = fn
+}
+
+// Writes returns all writes made to the device so far.
+func (d *SimDevice) Writes() []SimWrite {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]SimWrite{}, d.writes...)
+}
+
+// Opened and Closed report how many times the device was opened and closed.
+func (d *SimDevice) Opened() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.opened
+}
+
+func (d *SimDevice) Closed() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
+
+func (d *SimDevice) read(reg byte, buf []byte) {
+	var n int
+	if data, ok := d.mailbox[reg]; ok {
+		n = copy(buf, data)
+	} else {
+		n = copy(buf, d.regs[reg:])
+	}
+	for ; n < len(buf); n++ {
+		buf[n] = 0
+	}
+}
+
+func (d *SimDevice) write(reg byte, data []byte) {
+	copy(d.regs[reg:], data)
+}
+
+type simHandle struct {
+	dev    *SimDevice
+	closed bool
+}
+
+func (h *simHandle) ReadReg(reg byte, buf []byte) error {
+	d := h.dev
+	d.mu.Lock()
+	if err := h.check(d.readErr[reg]); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	fn := d.onRead[reg]
+	d.mu.Unlock()
+	if fn != nil {
+		fn(d)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.read(reg, buf)
+	return nil
+}
+
+func (h *simHandle) WriteReg(reg byte, buf []byte) error {
+	d := h.dev
+	d.mu.Lock()
+	if err := h.check(d.writeErr[reg]); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	data := append([]byte{}, buf...)
+	d.writes = append(d.writes, SimWrite{Reg: reg, Data: data})
+	d.write(reg, data)
+	fn := d.onWrite[reg]
+	d.mu.Unlock()
+	if fn != nil {
+		fn(d, append([]byte{}, data...))
+	}
+	return nil
+}
+
+func (h *simHandle) Close() error {
+	d := h.dev
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	d.closed++
+	return nil
+}
+
+// check must be called with the device lock held.
+func (h *simHandle) check(regErr error) error {
+	if h.closed {
+		return fmt.Errorf("i2c: device is closed")
+	}
+	if h.dev.fault != nil {
+		return h.dev.fault
+	}
+	return regErr
+}
@@ -0,0 +1,52 @@
+package serial
+
+import (
+	"sync"
+	"time"
+
+	tarm "github.com/tarm/serial"
+)
+
+// Port is a serial port as seen by the sensor drivers. Read returns what is
+// available after at most the configured read timeout; a timeout with no
+// data is reported as (0, io.EOF), as with a tty opened with VTIME.
+type Port interface {
+	Read(buf []byte) (int, error)
+	Write(buf []byte) (int, error)
+	Flush() error
+	Close() error
+}
+
+// Opener opens a port with the given baud rate and read timeout.
+type Opener func(baud int, readTimeout time.Duration) (Port, error)
+
+var (
+	openersMu sync.Mutex
+	openers   = map[string]Opener{}
+)
+
+// Register makes opener available under name, so that drivers configured
+// with serial_port = name use it instead of the tty with the same path.
+func Register(name string, opener Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	openers[name] = opener
+}
+
+// Unregister removes an opener added by Register.
+func Unregister(name string) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	delete(openers, name)
+}
+
+// Open opens the port named by name.
+func Open(name string, baud int, readTimeout time.Duration) (Port, error) {
+	openersMu.Lock()
+	opener, ok := openers[name]
+	openersMu.Unlock()
+	if ok {
+		return opener(baud, readTimeout)
+	}
+	return tarm.OpenPort(&tarm.Config{Name: name, Baud: baud, ReadTimeout: readTimeout})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+	"sensor-exporter/pipeline"
+	"sensor-exporter/sensor"
+
+	"gopkg.in/ini.v1"
+)
+
+// defaultConfigKeys are the keys accepted in the [default] section.
+var defaultConfigKeys = []sensor.ConfigKey{
+	{Name: "bind_ip", Default: "0.0.0.0", Help: "address to listen on"},
+	{Name: "bind_port", Default: "8080", Help: "port to listen on", Kind: sensor.KindInt, Check: sensor.IntRange(1, 65535)},
+	{Name: "enable_sensor", Default: "bme280,ccs811", Help: "comma separated sensor sections to use"},
+	{Name: "export_metrics", Default: "temperature,humidity,pressure,co2,voc", Help: "comma separated metrics names to export"},
+	{Name: "stale_after", Default: "0", Help: "drop the metrics of a sensor not read for this long, 0 to keep them", Kind: sensor.KindDuration},
+	{Name: "exporter_mode", Default: "push", Help: "push or collect", Check: sensor.OneOf("push", "collect")},
+	{Name: "collect_max_age", Default: "0", Help: "age up to which readings are reused in collect mode", Kind: sensor.KindDuration},
+	{Name: "retry_interval", Default: "1s", Help: "first retry interval of a failed sensor init", Kind: sensor.KindDuration, Check: sensor.Positive},
+	{Name: "retry_max_interval", Default: "5m", Help: "maximum retry interval of a failed sensor init", Kind: sensor.KindDuration, Check: sensor.Positive},
+	{Name: "reconnect_after", Default: "5", Help: "failed reads in a row before a sensor is initialized again, 0 to never", Kind: sensor.KindInt, Check: sensor.IntRange(0, 1<<31-1)},
+	{Name: "state_dir", Default: "/var/lib/sensor-exporter", Help: "directory where sensors keep state across restarts, empty to disable"},
+	{Name: "admin_token", Default: "", Help: "token required by the admin endpoints and /-/reload, empty to disable them"},
+	{Name: "enable_output", Default: "", Help: "comma separated outputs sending the readings to other systems"},
+}
+
+// checkConfig validates a config file and returns the problems found and
+// warnings that do not prevent the exporter from running.
+func checkConfig(path string) (problems []string, warnings []string, err error) {
+	c, err := config.Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := ini.InsensitiveLoad(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enabled := map[string]bool{}
+	for _, name := range c.Default.EnabledSensors {
+		if name == "" {
+			continue
+		}
+		if enabled[name] {
+			problems = append(problems, fmt.Sprintf("[default] enable_sensor: %s is listed twice", name))
+		}
+		enabled[name] = true
+		if _, err := sensor.LookupDriver(config.SensorType(name)); err != nil {
+			problems = append(problems, fmt.Sprintf("[default] enable_sensor: %v", err))
+		}
+	}
+
+	outputs := map[string]bool{}
+	for _, name := range c.Default.EnabledOutputs {
+		if outputs[name] {
+			problems = append(problems, fmt.Sprintf("[default] enable_output: %s is listed twice", name))
+		}
+		outputs[name] = true
+		d, err := output.LookupDriver(name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("[default] enable_output: %v", err))
+			continue
+		}
+		// keys without a valid default, such as the remote write url
+		for _, k := range d.ConfigKeys {
+			if !cfg.Section(name).HasKey(k.Name) && k.CheckValue(k.Default) != nil {
+				problems = append(problems, fmt.Sprintf("[%s] %s: is required", name, k.Name))
+			}
+		}
+	}
+
+	problems = append(problems, checkKeys(cfg.Section("default"), defaultConfigKeys, enabled)...)
+
+	for _, sec := range cfg.Sections() {
+		name := sec.Name()
+		if name == ini.DefaultSection || name == "default" {
+			continue
+		}
+		if config.IsOutput(name) {
+			d, err := output.LookupDriver(name)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("[%s]: %v", name, err))
+				continue
+			}
+			if !outputs[name] {
+				warnings = append(warnings, fmt.Sprintf("[%s]: section is not listed in enable_output", name))
+			}
+			problems = append(problems, checkKeys(sec, d.ConfigKeys, enabled)...)
+			continue
+		}
+		driver, err := sensor.LookupDriver(config.SensorType(name))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("[%s]: unknown section, %v", name, err))
+			continue
+		}
+		if !enabled[name] {
+			warnings = append(warnings, fmt.Sprintf("[%s]: section is not listed in enable_sensor", name))
+		}
+		problems = append(problems, checkKeys(sec, append(append([]sensor.ConfigKey{}, sensor.CommonConfigKeys...), driver.ConfigKeys...), enabled)...)
+		problems = append(problems, checkMetricsNames(sec)...)
+	}
+
+	// collect the metrics the enabled sensors produce
+	config.Set(c)
+	producers := map[string]map[string]bool{}
+	for name := range enabled {
+		s, err := sensor.New(name)
+		if err != nil {
+			continue
+		}
+		// invalid keys of the pipeline were reported above
+		pl, _ := pipeline.New(cfg.Section(name), nil)
+		desc := s.GetMetricsDescriptions()
+		problems = append(problems, checkMetricsKeys(cfg.Section(name), desc)...)
+		for metrics := range pl.Describe(desc) {
+			if producers[metrics] == nil {
+				producers[metrics] = map[string]bool{}
+			}
+			producers[metrics][config.SensorType(name)] = true
+		}
+	}
+	for _, metrics := range c.Default.ExportMetrics {
+		if metrics == "" {
+			continue
+		}
+		if producers[metrics] == nil {
+			problems = append(problems, fmt.Sprintf("[default] export_metrics: no enabled sensor produces %s", metrics))
+		}
+	}
+	for metrics, types := range producers {
+		if len(types) > 1 {
+			problems = append(problems, fmt.Sprintf("metrics %s is produced by different sensor types: %s", metrics, strings.Join(sortedKeys(types), ", ")))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems, warnings, nil
+}
+
+func checkKeys(sec *ini.Section, known []sensor.ConfigKey, enabled map[string]bool) []string {
+	problems := []string{}
+	keys := map[string]sensor.ConfigKey{}
+	prefixes := []sensor.ConfigKey{}
+	for _, k := range known {
+		keys[k.Name] = k
+		if k.Prefix {
+			prefixes = append(prefixes, k)
+		}
+	}
+	for _, key := range sec.Keys() {
+		k, ok := keys[key.Name()]
+		for _, prefix := range prefixes {
+			if !ok && strings.HasPrefix(key.Name(), prefix.Name) {
+				k, ok = prefix, true
+			}
+		}
+		if !ok || k.Prefix && key.Name() == k.Name {
+			problems = append(problems, fmt.Sprintf("[%s] %s: unknown key", sec.Name(), key.Name()))
+			continue
+		}
+		if err := k.CheckValue(key.String()); err != nil {
+			problems = append(problems, fmt.Sprintf("[%s] %s: %v", sec.Name(), key.Name(), err))
+		}
+		if k.Kind == sensor.KindSensor && key.String() != "" && !enabled[key.String()] {
+			problems = append(problems, fmt.Sprintf("[%s] %s: %s is not an enabled sensor", sec.Name(), key.Name(), key.String()))
+		}
+	}
+	return problems
+}
+
+// checkMetricsKeys reports keys such as offset_<metrics> naming metrics
+// the sensor does not produce.
+func checkMetricsKeys(sec *ini.Section, desc map[string]string) []string {
+	problems := []string{}
+	metrics := map[string]bool{}
+	for name := range desc {
+		metrics[strings.ToLower(name)] = true
+	}
+	for _, key := range sec.Keys() {
+		for _, k := range sensor.CommonConfigKeys {
+			if !k.Prefix || !strings.HasPrefix(key.Name(), k.Name) || key.Name() == k.Name {
+				continue
+			}
+			if name := strings.TrimPrefix(key.Name(), k.Name); !metrics[name] {
+				problems = append(problems, fmt.Sprintf("[%s] %s: the sensor has no metrics %s", sec.Name(), key.Name(), name))
+			}
+		}
+	}
+	return problems
+}
+
+// checkMetricsNames reports metrics_name_* keys of a section sharing a name.
+func checkMetricsNames(sec *ini.Section) []string {
+	problems := []string{}
+	seen := map[string]string{}
+	for _, key := range sec.Keys() {
+		if !strings.HasPrefix(key.Name(), "metrics_name_") {
+			continue
+		}
+		if other, ok := seen[key.String()]; ok {
+			problems = append(problems, fmt.Sprintf("[%s] %s: metrics name %s is also used by %s", sec.Name(), key.Name(), key.String(), other))
+			continue
+		}
+		seen[key.String()] = key.Name()
+	}
+	return problems
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runCheckConfig implements the check-config command and returns the exit
+// status.
+func runCheckConfig(path string) int {
+	problems, warnings, err := checkConfig(path)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return 1
+	}
+	for _, w := range warnings {
+		fmt.Printf("%s: warning: %s\n", path, w)
+	}
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", path, p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problems found\n", path, len(problems))
+		return 1
+	}
+	fmt.Printf("%s: OK\n", path)
+	return 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sensorCollector reads the sensors at scrape time and emits the readings
+// as const metrics stamped with the time they were read. It is used instead
+// of the gauges when exporter_mode = collect.
+type sensorCollector struct {
+	descs map[string]*prometheus.Desc
+}
+
+func newSensorCollector(help map[string]string, exportMetrics []string) *sensorCollector {
+	descs := make(map[string]*prometheus.Desc, len(exportMetrics))
+	for _, metrics := range exportMetrics {
+		descs[metrics] = prometheus.NewDesc(metrics, help[metrics], []string{"sensor_name", "sensor_instance"}, nil)
+	}
+	return &sensorCollector{descs: descs}
+}
+
+func (c *sensorCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *sensorCollector) Collect(ch chan<- prometheus.Metric) {
+	maxAge := getConf().CollectMaxAge
+	for _, p := range getPollers() {
+		data, readAt, ok := p.cachedReading(maxAge)
+		if !ok {
+			continue
+		}
+		for metrics, value := range data {
+			desc, ok := c.descs[metrics]
+			if !ok {
+				continue
+			}
+			ch <- prometheus.NewMetricWithTimestamp(readAt, prometheus.MustNewConstMetric(
+				desc, prometheus.GaugeValue, value, p.sensor.GetSensorName(), p.sensor.GetInstanceName()))
+		}
+	}
+}
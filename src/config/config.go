@@ -2,6 +2,12 @@ package config
 
 import (
 	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"sensor-exporter/util"
 
@@ -13,82 +19,494 @@ type Default struct {
 	BindPort       string
 	EnabledSensors []string
 	ExportMetrics  []string
+	StaleAfter     time.Duration
+	// "push" updates gauges on every poll, "collect" reads the sensors when
+	// scraped, serving readings up to CollectMaxAge old from a cache
+	ExporterMode  string
+	CollectMaxAge time.Duration
+	// retry of sensors that failed to init or stopped responding
+	RetryInterval    time.Duration
+	RetryMaxInterval time.Duration
+	ReconnectAfter   int
+	// directory where sensors keep state across restarts, empty to disable
+	StateDir string
+	// token required by the admin endpoints and /-/reload, empty to disable them
+	AdminToken string `secret:"true"`
+	// outputs sending the readings to other systems
+	EnabledOutputs []string
+}
+
+// Sensor holds the keys common to every sensor section.
+type Sensor struct {
+	Name         string
+	PollInterval time.Duration
 }
 
 type Bme280 struct {
+	Name                   string
 	I2cDevice              string
 	I2cAddress             int
 	TemperatureMetricsName string
 	HumidityMetricsName    string
 	PressureMetricsName    string
+	// measurement settings, see the datasheet
+	Mode              string
+	OversamplingTemp  int
+	OversamplingHumid int
+	OversamplingPress int
+	Filter            int
+	Standby           time.Duration
+	// derived metrics, disabled if the name is empty
+	DewPointMetricsName         string
+	AbsoluteHumidityMetricsName string
+	HeatIndexMetricsName        string
+	HumidexMetricsName          string
+	VpdMetricsName              string
+	AltitudeMetricsName         string
+	SeaLevelPressureMetricsName string
+	SeaLevelPressure            float64
+	Altitude                    float64
 }
 
 type Ccs811 struct {
-	I2cDevice      string
-	I2cAddress     int
-	Co2MetricsName string
-	VocMetricsName string
-	Baseline       int
+	Name                string
+	I2cDevice           string
+	I2cAddress          int
+	Co2MetricsName      string
+	VocMetricsName      string
+	BaselineMetricsName string
+	Baseline            int
+	BurnIn              time.Duration
+	BaselineMaxAge      time.Duration
+	// sensor section whose temperature and humidity are written to ENV_DATA
+	EnvSource string
+	EnvMaxAge time.Duration
+}
+
+type Mqtt struct {
+	Broker             string
+	ClientId           string
+	Username           string
+	Password           string `secret:"true"`
+	TopicPrefix        string
+	Format             string
+	Qos                int
+	Retain             bool
+	KeepAlive          time.Duration
+	CaFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	Discovery          bool
+	DiscoveryPrefix    string
+}
+
+type Influxdb struct {
+	Url                string
+	Api                string
+	Database           string
+	RetentionPolicy    string
+	Username           string
+	Password           string `secret:"true"`
+	Org                string
+	Bucket             string
+	Token              string `secret:"true"`
+	Host               string
+	BatchSize          int
+	FlushInterval      time.Duration
+	Timeout            time.Duration
+	BufferFile         string
+	BufferSize         int64
+	CaFile             string
+	InsecureSkipVerify bool
+}
+
+type RemoteWrite struct {
+	Url                string
+	Interval           time.Duration
+	Timeout            time.Duration
+	Username           string
+	Password           string `secret:"true"`
+	BearerToken        string `secret:"true"`
+	ExternalLabels     map[string]string
+	BatchSize          int
+	WalFile            string
+	WalSize            int64
+	CaFile             string
+	InsecureSkipVerify bool
+}
+
+type History struct {
+	Dir           string
+	RawRetention  time.Duration
+	Downsample    string
+	FlushInterval time.Duration
+	MaxPoints     int
+}
+
+type FileLogger struct {
+	Path           string
+	Format         string
+	Utc            bool
+	FlushInterval  time.Duration
+	RotateSize     int64
+	RotateInterval time.Duration
+	Compress       bool
+	MaxFiles       int
+	MaxAge         time.Duration
 }
 
 type Mhz19c struct {
+	Name            string
 	SerialPort      string
 	SerialBaudrate  int
 	Co2MetricsName  string
 	SelfCalibration bool
 }
 
+// Config holds the sensor sections keyed by section name. A sensor type can
+// have several instances, e.g. [bme280.livingroom] and [bme280.outdoor].
 type Config struct {
 	Default Default
-	Bme280  Bme280
-	Ccs811  Ccs811
-	Mhz19c  Mhz19c
+	Sensors map[string]Sensor
+	Bme280  map[string]Bme280
+	Ccs811  map[string]Ccs811
+	Mhz19c  map[string]Mhz19c
+
+	// outputs, configured in the section of their name
+	Mqtt        Mqtt
+	Influxdb    Influxdb
+	RemoteWrite RemoteWrite
+	History     History
+	FileLogger  FileLogger
+
+	file *ini.File
 }
 
 var (
+	mu            sync.RWMutex
 	configuration Config
 )
 
+// Init loads the config file and makes it the current configuration.
 func Init(configPath string) error {
-	cfg, err := ini.InsensitiveLoad(configPath)
+	c, err := Load(configPath)
 	if err != nil {
 		return err
 	}
-	configuration = Config{
+	Set(c)
+	return nil
+}
+
+// Load reads a config file without changing the current configuration.
+func Load(configPath string) (Config, error) {
+	cfg, err := ini.InsensitiveLoad(configPath)
+	if err != nil {
+		return Config{}, err
+	}
+	c := Config{
 		Default: Default{
-			BindIp:         cfg.Section("default").Key("bind_ip").MustString("0.0.0.0"),
-			BindPort:       cfg.Section("default").Key("bind_port").MustString("8080"),
-			EnabledSensors: util.ParseStringToSlice(cfg.Section("default").Key("enable_sensor").MustString("bme280,ccs811")),
-			ExportMetrics:  util.ParseStringToSlice(cfg.Section("default").Key("export_metrics").MustString("temperature,humidity,pressure,co2,voc")),
-		},
-		Bme280: Bme280{
-			I2cDevice:              cfg.Section("bme280").Key("i2c_device").MustString("/dev/i2c-1"),
-			I2cAddress:             cfg.Section("bme280").Key("i2c_address").MustInt(0x76),
-			TemperatureMetricsName: cfg.Section("bme280").Key("metrics_name_temp").MustString("temperature"),
-			HumidityMetricsName:    cfg.Section("bme280").Key("metrics_name_humid").MustString("humidity"),
-			PressureMetricsName:    cfg.Section("bme280").Key("metrics_name_press").MustString("pressure"),
-		},
-		Ccs811: Ccs811{
-			I2cDevice:      cfg.Section("ccs811").Key("i2c_device").MustString("/dev/i2c-1"),
-			I2cAddress:     cfg.Section("ccs811").Key("i2c_address").MustInt(0x5a),
-			Co2MetricsName: cfg.Section("ccs811").Key("metrics_name_eco2").MustString("eco2"),
-			VocMetricsName: cfg.Section("ccs811").Key("metrics_name_evoc").MustString("tvoc"),
-			Baseline:       cfg.Section("ccs811").Key("baseline").MustInt(0),
-		},
-		Mhz19c: Mhz19c{
-			SerialPort:      cfg.Section("mhz19c").Key("serial_port").MustString("/dev/serial0"),
-			SerialBaudrate:  cfg.Section("mhz19c").Key("serial_baudrate").MustInt(9600),
-			Co2MetricsName:  cfg.Section("mhz19c").Key("metrics_name_co2").MustString("co2"),
-			SelfCalibration: cfg.Section("mhz19c").Key("self_calibration").MustBool(true),
+			BindIp:           cfg.Section("default").Key("bind_ip").MustString("0.0.0.0"),
+			BindPort:         cfg.Section("default").Key("bind_port").MustString("8080"),
+			EnabledSensors:   util.ParseStringToSlice(cfg.Section("default").Key("enable_sensor").MustString("bme280,ccs811")),
+			ExportMetrics:    util.ParseStringToSlice(cfg.Section("default").Key("export_metrics").MustString("temperature,humidity,pressure,co2,voc")),
+			StaleAfter:       cfg.Section("default").Key("stale_after").MustDuration(0),
+			ExporterMode:     cfg.Section("default").Key("exporter_mode").In("push", []string{"push", "collect"}),
+			CollectMaxAge:    cfg.Section("default").Key("collect_max_age").MustDuration(0),
+			RetryInterval:    cfg.Section("default").Key("retry_interval").MustDuration(time.Second),
+			RetryMaxInterval: cfg.Section("default").Key("retry_max_interval").MustDuration(5 * time.Minute),
+			ReconnectAfter:   cfg.Section("default").Key("reconnect_after").MustInt(5),
+			StateDir:         cfg.Section("default").Key("state_dir").MustString("/var/lib/sensor-exporter"),
+			AdminToken:       cfg.Section("default").Key("admin_token").MustString(""),
+			EnabledOutputs:   nonEmpty(util.ParseStringToSlice(cfg.Section("default").Key("enable_output").MustString(""))),
 		},
+		Sensors: map[string]Sensor{},
+		Bme280:  map[string]Bme280{},
+		Ccs811:  map[string]Ccs811{},
+		Mhz19c:  map[string]Mhz19c{},
 	}
-	return nil
+	hostname, _ := os.Hostname()
+	sec := cfg.Section("mqtt")
+	c.Mqtt = Mqtt{
+		Broker:             sec.Key("broker").MustString("tcp://localhost:1883"),
+		ClientId:           sec.Key("client_id").MustString("sensor-exporter-" + hostname),
+		Username:           sec.Key("username").MustString(""),
+		Password:           sec.Key("password").MustString(""),
+		TopicPrefix:        strings.TrimSuffix(sec.Key("topic_prefix").MustString("sensor-exporter/"+hostname), "/"),
+		Format:             sec.Key("format").In("plain", []string{"plain", "json"}),
+		Qos:                sec.Key("qos").RangeInt(0, 0, 1),
+		Retain:             sec.Key("retain").MustBool(false),
+		KeepAlive:          sec.Key("keep_alive").MustDuration(60 * time.Second),
+		CaFile:             sec.Key("ca_file").MustString(""),
+		CertFile:           sec.Key("cert_file").MustString(""),
+		KeyFile:            sec.Key("key_file").MustString(""),
+		InsecureSkipVerify: sec.Key("insecure_skip_verify").MustBool(false),
+		Discovery:          sec.Key("discovery").MustBool(false),
+		DiscoveryPrefix:    sec.Key("discovery_prefix").MustString("homeassistant"),
+	}
+
+	sec = cfg.Section("influxdb")
+	c.Influxdb = Influxdb{
+		Url:                strings.TrimSuffix(sec.Key("url").MustString("http://localhost:8086"), "/"),
+		Api:                sec.Key("api").In("v2", []string{"v1", "v2"}),
+		Database:           sec.Key("database").MustString("sensors"),
+		RetentionPolicy:    sec.Key("retention_policy").MustString(""),
+		Username:           sec.Key("username").MustString(""),
+		Password:           sec.Key("password").MustString(""),
+		Org:                sec.Key("org").MustString(""),
+		Bucket:             sec.Key("bucket").MustString("sensors"),
+		Token:              sec.Key("token").MustString(""),
+		Host:               sec.Key("host").MustString(hostname),
+		BatchSize:          sec.Key("batch_size").MustInt(1000),
+		FlushInterval:      sec.Key("flush_interval").MustDuration(10 * time.Second),
+		Timeout:            sec.Key("timeout").MustDuration(10 * time.Second),
+		BufferFile:         sec.Key("buffer_file").MustString(stateFile(c.Default.StateDir, "influxdb.buffer")),
+		BufferSize:         sec.Key("buffer_size").MustInt64(16 << 20),
+		CaFile:             sec.Key("ca_file").MustString(""),
+		InsecureSkipVerify: sec.Key("insecure_skip_verify").MustBool(false),
+	}
+
+	sec = cfg.Section("remote_write")
+	c.RemoteWrite = RemoteWrite{
+		Url:                sec.Key("url").MustString(""),
+		Interval:           sec.Key("interval").MustDuration(15 * time.Second),
+		Timeout:            sec.Key("timeout").MustDuration(30 * time.Second),
+		Username:           sec.Key("username").MustString(""),
+		Password:           sec.Key("password").MustString(""),
+		BearerToken:        sec.Key("bearer_token").MustString(""),
+		ExternalLabels:     ParseLabels(sec.Key("external_labels").MustString("job=sensor-exporter,instance=" + hostname)),
+		BatchSize:          sec.Key("batch_size").MustInt(20),
+		WalFile:            sec.Key("wal_file").MustString(stateFile(c.Default.StateDir, "remote_write.wal")),
+		WalSize:            sec.Key("wal_size").MustInt64(16 << 20),
+		CaFile:             sec.Key("ca_file").MustString(""),
+		InsecureSkipVerify: sec.Key("insecure_skip_verify").MustBool(false),
+	}
+
+	sec = cfg.Section("history")
+	c.History = History{
+		Dir:           sec.Key("dir").MustString(stateFile(c.Default.StateDir, "history")),
+		RawRetention:  sec.Key("raw_retention").MustDuration(24 * time.Hour),
+		Downsample:    sec.Key("downsample").MustString("5m:720h, 1h:8760h"),
+		FlushInterval: sec.Key("flush_interval").MustDuration(time.Minute),
+		MaxPoints:     sec.Key("max_points").MustInt(10000),
+	}
+
+	sec = cfg.Section("file_logger")
+	c.FileLogger = FileLogger{
+		Path:           sec.Key("path").MustString("/var/log/sensor-exporter/readings.csv"),
+		Format:         sec.Key("format").In("csv", []string{"csv", "jsonl"}),
+		Utc:            sec.Key("utc").MustBool(false),
+		FlushInterval:  sec.Key("flush_interval").MustDuration(10 * time.Second),
+		RotateSize:     sec.Key("rotate_size").MustInt64(10 << 20),
+		RotateInterval: sec.Key("rotate_interval").MustDuration(24 * time.Hour),
+		Compress:       sec.Key("compress").MustBool(true),
+		MaxFiles:       sec.Key("max_files").MustInt(30),
+		MaxAge:         sec.Key("max_age").MustDuration(0),
+	}
+
+	for _, name := range sensorSections(cfg, c.Default.EnabledSensors) {
+		sec := cfg.Section(name)
+		pollInterval := sec.Key("poll_interval").MustDuration(time.Second)
+		if pollInterval <= 0 {
+			pollInterval = time.Second
+		}
+		c.Sensors[name] = Sensor{
+			Name:         name,
+			PollInterval: pollInterval,
+		}
+		switch SensorType(name) {
+		case "bme280":
+			c.Bme280[name] = Bme280{
+				Name:                        name,
+				I2cDevice:                   sec.Key("i2c_device").MustString("/dev/i2c-1"),
+				I2cAddress:                  sec.Key("i2c_address").MustInt(0x76),
+				TemperatureMetricsName:      sec.Key("metrics_name_temp").MustString("temperature"),
+				HumidityMetricsName:         sec.Key("metrics_name_humid").MustString("humidity"),
+				PressureMetricsName:         sec.Key("metrics_name_press").MustString("pressure"),
+				Mode:                        sec.Key("mode").MustString("normal"),
+				OversamplingTemp:            sec.Key("oversampling_temp").MustInt(1),
+				OversamplingHumid:           sec.Key("oversampling_humid").MustInt(1),
+				OversamplingPress:           sec.Key("oversampling_press").MustInt(1),
+				Filter:                      sec.Key("filter").MustInt(8),
+				Standby:                     sec.Key("standby").MustDuration(time.Second),
+				DewPointMetricsName:         sec.Key("metrics_name_dew_point").MustString(""),
+				AbsoluteHumidityMetricsName: sec.Key("metrics_name_abs_humid").MustString(""),
+				HeatIndexMetricsName:        sec.Key("metrics_name_heat_index").MustString(""),
+				HumidexMetricsName:          sec.Key("metrics_name_humidex").MustString(""),
+				VpdMetricsName:              sec.Key("metrics_name_vpd").MustString(""),
+				AltitudeMetricsName:         sec.Key("metrics_name_altitude").MustString(""),
+				SeaLevelPressureMetricsName: sec.Key("metrics_name_sea_level_press").MustString(""),
+				SeaLevelPressure:            sec.Key("sea_level_pressure").MustFloat64(1013.25),
+				Altitude:                    sec.Key("altitude").MustFloat64(0),
+			}
+		case "ccs811":
+			c.Ccs811[name] = Ccs811{
+				Name:                name,
+				I2cDevice:           sec.Key("i2c_device").MustString("/dev/i2c-1"),
+				I2cAddress:          sec.Key("i2c_address").MustInt(0x5a),
+				Co2MetricsName:      sec.Key("metrics_name_eco2").MustString("eco2"),
+				VocMetricsName:      sec.Key("metrics_name_evoc").MustString("tvoc"),
+				BaselineMetricsName: sec.Key("metrics_name_baseline").MustString("ccs811_baseline"),
+				Baseline:            sec.Key("baseline").MustInt(0),
+				BurnIn:              sec.Key("burn_in").MustDuration(48 * time.Hour),
+				BaselineMaxAge:      sec.Key("baseline_max_age").MustDuration(7 * 24 * time.Hour),
+				EnvSource:           sec.Key("env_source").MustString(""),
+				EnvMaxAge:           sec.Key("env_max_age").MustDuration(5 * time.Minute),
+			}
+		case "mhz19c":
+			c.Mhz19c[name] = Mhz19c{
+				Name:            name,
+				SerialPort:      sec.Key("serial_port").MustString("/dev/serial0"),
+				SerialBaudrate:  sec.Key("serial_baudrate").MustInt(9600),
+				Co2MetricsName:  sec.Key("metrics_name_co2").MustString("co2"),
+				SelfCalibration: sec.Key("self_calibration").MustBool(true),
+			}
+		}
+	}
+	c.file = cfg
+	return c, nil
+}
+
+// Set makes c the current configuration.
+func Set(c Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	configuration = c
+}
+
+// SensorType returns the driver name of a sensor section, e.g. "bme280" for
+// both [bme280] and [bme280.outdoor].
+func SensorType(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// sensorSections returns the enabled sensor names followed by any other
+// sensor sections in the file.
+func sensorSections(cfg *ini.File, enabled []string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, name := range enabled {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range cfg.SectionStrings() {
+		if name == ini.DefaultSection || name == "default" || IsOutput(name) || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// outputs are the sections configuring outputs rather than sensors.
+var outputs = map[string]bool{
+	"mqtt":         true,
+	"influxdb":     true,
+	"remote_write": true,
+	"history":      true,
+	"file_logger":  true,
+}
+
+// ParseLabels parses name=value pairs separated by commas, ignoring pairs
+// without a name.
+func ParseLabels(s string) map[string]string {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if name := strings.TrimSpace(kv[0]); name != "" && len(kv) == 2 {
+			labels[name] = strings.TrimSpace(kv[1])
+		}
+	}
+	return labels
+}
+
+// stateFile returns the path of a file in dir, or "" if dir is empty.
+func stateFile(dir, name string) string {
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
+
+// IsOutput reports whether section name configures an output.
+func IsOutput(name string) bool {
+	return outputs[name]
+}
+
+func nonEmpty(list []string) []string {
+	out := []string{}
+	for _, s := range list {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Section gives drivers outside of this package access to their raw
+// config section.
+func Section(name string) *ini.Section {
+	return GetConfig().Section(name)
+}
+
+func (c Config) Section(name string) *ini.Section {
+	if c.file == nil {
+		return ini.Empty().Section(name)
+	}
+	return c.file.Section(name)
+}
+
+// SectionChanged reports whether the keys of section name differ between
+// the configurations a and b.
+func SectionChanged(a, b Config, name string) bool {
+	return !reflect.DeepEqual(a.keys(name), b.keys(name))
+}
+
+func (c Config) keys(name string) map[string]string {
+	if c.file == nil {
+		return nil
+	}
+	sec, err := c.file.GetSection(name)
+	if err != nil {
+		return nil
+	}
+	return sec.KeysHash()
 }
 
 func GetConfig() Config {
+	mu.RLock()
+	defer mu.RUnlock()
 	return configuration
 }
 
+// redacted is logged in place of the passwords and tokens.
+const redacted = "<redacted>"
+
+// Redacted returns a copy of c without its passwords and tokens, the
+// string fields of its sections tagged `secret:"true"`.
+func (c Config) Redacted() Config {
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		section := v.Field(i)
+		if section.Kind() != reflect.Struct || !section.CanSet() {
+			continue
+		}
+		for j := 0; j < section.NumField(); j++ {
+			f := section.Field(j)
+			if section.Type().Field(j).Tag.Get("secret") == "true" && f.Kind() == reflect.String && f.String() != "" {
+				f.SetString(redacted)
+			}
+		}
+	}
+	return c
+}
+
 func DumpConfig() {
-	log.Printf("Condig dump:\n%+v\n", configuration)
+	log.Printf("Config dump:\n%+v\n", GetConfig().Redacted())
 }
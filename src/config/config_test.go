@@ -0,0 +1,71 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDumpConfigRedactsSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sensor-exporter.conf")
+	err := ioutil.WriteFile(path, []byte(`[default]
+admin_token = admin-secret
+[mqtt]
+username = exporter
+password = mqtt-secret
+[influxdb]
+password = influx-secret
+token = influx-token
+[remote_write]
+password = rw-secret
+bearer_token = rw-token
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(path); err != nil {
+		t.Fatal(err)
+	}
+	defer Set(Config{})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	DumpConfig()
+	for _, secret := range []string{"admin-secret", "mqtt-secret", "influx-secret", "influx-token", "rw-secret", "rw-token"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("config dump contains %q", secret)
+		}
+	}
+	if !strings.Contains(buf.String(), "exporter") {
+		t.Errorf("config dump lacks the mqtt username")
+	}
+
+	// the config itself is not changed
+	if c := GetConfig(); c.Mqtt.Password != "mqtt-secret" || c.Default.AdminToken != "admin-secret" {
+		t.Errorf("Redacted changed the current config")
+	}
+}
+
+// TestSecretsTagged catches a password or token added without the secret
+// tag, which would be logged by DumpConfig.
+func TestSecretsTagged(t *testing.T) {
+	c := reflect.TypeOf(Config{})
+	for i := 0; i < c.NumField(); i++ {
+		section := c.Field(i).Type
+		if section.Kind() != reflect.Struct {
+			continue
+		}
+		for j := 0; j < section.NumField(); j++ {
+			f := section.Field(j)
+			if (strings.HasSuffix(f.Name, "Password") || strings.HasSuffix(f.Name, "Token")) && f.Tag.Get("secret") != "true" {
+				t.Errorf("%s.%s is not tagged secret", section.Name(), f.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+// Sensor drivers register themselves with the sensor package when imported,
+// outputs with the output package. Add the import of a new driver or output
+// package here to make it available.
+import (
+	_ "sensor-exporter/output/filelogger"
+	_ "sensor-exporter/output/history"
+	_ "sensor-exporter/output/influxdb"
+	_ "sensor-exporter/output/mqtt"
+	_ "sensor-exporter/output/remotewrite"
+	_ "sensor-exporter/sensor/bme280"
+	_ "sensor-exporter/sensor/ccs811"
+	_ "sensor-exporter/sensor/mhz19c"
+)
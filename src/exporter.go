@@ -4,7 +4,10 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"reflect"
 	"sensor-exporter/sensor"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -12,33 +15,172 @@ import (
 )
 
 var (
-	srv       *http.Server
-	reg       = prometheus.NewRegistry()
-	gaugeVecs map[string]*prometheus.GaugeVec
+	srv *http.Server
+	reg = prometheus.NewRegistry()
+
+	// metrics of the sensor readings, replaced on config reload
+	metricsMu    sync.RWMutex
+	gaugeVecs    map[string]*prometheus.GaugeVec
+	metricsNames []string
+	metricsHelp  map[string]string
+	metricsMode  string
+	collector    *sensorCollector
+
+	// health of the sensors
+	sensorUp          *prometheus.GaugeVec
+	sensorLastSuccess *prometheus.GaugeVec
+	sensorReadErrors  *prometheus.CounterVec
+	sensorChipInfo    *prometheus.GaugeVec
 )
 
 func initExporter() {
-	desc := sensor.GetDescriptions(conf.ExportMetrics)
-	gaugeVecs = make(map[string]*prometheus.GaugeVec, len(conf.ExportMetrics))
-	for _, metrics := range conf.ExportMetrics {
+	registerSensorMetrics()
+
+	sensorUp = promauto.With(reg).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sensor_up",
+			Help: "1 if the last read of the sensor succeeded, 0 otherwise",
+		},
+		[]string{"sensor_name", "sensor_instance"},
+	)
+	sensorLastSuccess = promauto.With(reg).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sensor_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful read of the sensor",
+		},
+		[]string{"sensor_name", "sensor_instance"},
+	)
+	sensorReadErrors = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sensor_read_errors_total",
+			Help: "Number of failed reads of the sensor",
+		},
+		[]string{"sensor_name", "sensor_instance"},
+	)
+	sensorChipInfo = promauto.With(reg).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sensor_chip_info",
+			Help: "Chip detected by the sensor driver, always 1",
+		},
+		[]string{"sensor_name", "sensor_instance", "chip", "chip_id"},
+	)
+	for _, d := range sensor.Drivers() {
+		for _, c := range d.Collectors {
+			reg.MustRegister(c)
+		}
+	}
+}
+
+// registerSensorMetrics registers the metrics named in export_metrics, as
+// gauges or, in collect mode, as a collector reading the sensors.
+func registerSensorMetrics() {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	c := getConf()
+	metricsHelp = sensor.GetDescriptions(getDescriptions(), c.ExportMetrics)
+	metricsNames = c.ExportMetrics
+	metricsMode = c.ExporterMode
+	gaugeVecs = make(map[string]*prometheus.GaugeVec, len(c.ExportMetrics))
+	if c.ExporterMode == "collect" {
+		// the sensors are read at scrape time, gaugeVecs stays empty
+		collector = newSensorCollector(metricsHelp, c.ExportMetrics)
+		reg.MustRegister(collector)
+		return
+	}
+	for _, metrics := range c.ExportMetrics {
 		gaugeVecs[metrics] = promauto.With(reg).NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: metrics,
-				Help: desc[metrics],
+				Help: metricsHelp[metrics],
 			},
-			[]string{"sensor_name"},
+			// "instance" is attached by Prometheus to every scraped series,
+			// so the section name is exported as "sensor_instance".
+			[]string{"sensor_name", "sensor_instance"},
 		)
 	}
+}
+
+// reloadSensorMetrics registers the metrics again if export_metrics, the
+// exporter mode or the help texts changed.
+func reloadSensorMetrics() {
+	c := getConf()
+	metricsMu.Lock()
+	changed := metricsMode != c.ExporterMode ||
+		!reflect.DeepEqual(metricsNames, c.ExportMetrics) ||
+		!reflect.DeepEqual(metricsHelp, sensor.GetDescriptions(getDescriptions(), c.ExportMetrics))
+	if changed {
+		for _, gaugeVec := range gaugeVecs {
+			reg.Unregister(gaugeVec)
+		}
+		if collector != nil {
+			reg.Unregister(collector)
+			collector = nil
+		}
+	}
+	metricsMu.Unlock()
+	if changed {
+		log.Println("Register the sensor metrics again")
+		registerSensorMetrics()
+	}
+}
+
+func setExportValue(metricsName string, s sensor.Sensor, value float64) {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	gaugeVec, ok := gaugeVecs[metricsName]
+	if !ok {
+		return
+	}
+	gaugeVec.WithLabelValues(s.GetSensorName(), s.GetInstanceName()).Set(value)
+}
+
+// deleteExportValues removes the series of the sensor, so that Prometheus
+// does not keep scraping a value that is no longer updated.
+func deleteExportValues(metricsNames []string, s sensor.Sensor) {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	for _, metricsName := range metricsNames {
+		if gaugeVec, ok := gaugeVecs[metricsName]; ok {
+			gaugeVec.DeleteLabelValues(s.GetSensorName(), s.GetInstanceName())
+		}
+	}
+}
+
+func setSensorHealth(s sensor.Sensor, err error, lastSuccess time.Time) {
+	if err != nil {
+		sensorUp.WithLabelValues(s.GetSensorName(), s.GetInstanceName()).Set(0)
+		sensorReadErrors.WithLabelValues(s.GetSensorName(), s.GetInstanceName()).Inc()
+		return
+	}
+	sensorUp.WithLabelValues(s.GetSensorName(), s.GetInstanceName()).Set(1)
+	sensorLastSuccess.WithLabelValues(s.GetSensorName(), s.GetInstanceName()).Set(float64(lastSuccess.UnixNano()) / 1e9)
+	sensorReadErrors.WithLabelValues(s.GetSensorName(), s.GetInstanceName())
+}
+
+func setChipInfo(s sensor.Sensor, chip []string) {
+	sensorChipInfo.WithLabelValues(append([]string{s.GetSensorName(), s.GetInstanceName()}, chip...)...).Set(1)
+}
 
+func deleteChipInfo(s sensor.Sensor, chip []string) {
+	sensorChipInfo.DeleteLabelValues(append([]string{s.GetSensorName(), s.GetInstanceName()}, chip...)...)
 }
 
-func setExportValue(metricsName string, sensorName string) {
-	gaugeVecs[metricsName].WithLabelValues(sensorName).Set(data[metricsName])
+func deleteSensorHealth(s sensor.Sensor) {
+	sensorUp.DeleteLabelValues(s.GetSensorName(), s.GetInstanceName())
+	sensorLastSuccess.DeleteLabelValues(s.GetSensorName(), s.GetInstanceName())
+	sensorReadErrors.DeleteLabelValues(s.GetSensorName(), s.GetInstanceName())
 }
 
 func runExporter() {
 	srv = &http.Server{Addr: conf.BindIp + ":" + conf.BindPort}
 	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	http.HandleFunc("/-/reload", reloadHandler)
+	http.HandleFunc("/-/sensors/", sensorCommandHandler)
+	http.HandleFunc("/api/v1/sensors", apiSensorsHandler)
+	http.HandleFunc("/api/v1/sensors/", apiSensorsHandler)
+	http.HandleFunc("/api/v1/readings", apiReadingsHandler)
+	http.HandleFunc("/api/v1/history", apiHistoryHandler)
+	http.HandleFunc("/api/v1/history/", apiHistoryHandler)
 	log.Fatal(srv.ListenAndServe())
 }
 
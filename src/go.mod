@@ -3,8 +3,13 @@ module sensor-exporter
 go 1.16
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/golang/snappy v0.0.4
 	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	golang.org/x/exp v0.0.0-20210430132503-b698a44fee45
+	golang.org/x/net v0.11.0 // indirect
+	google.golang.org/protobuf v1.23.0
 	gopkg.in/ini.v1 v1.62.0
 )
@@ -2,15 +2,16 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"sensor-exporter/config"
+	"sensor-exporter/output"
 	"sensor-exporter/sensor"
 )
 
@@ -18,43 +19,56 @@ var (
 	// args
 	outputStdout int
 	confPath     string
+	listDrivers  bool
 	conf         config.Default
-	sensors      []sensor.Sensor
-	data         map[string]float64
+	pollers      []*poller
 	headerData   string
 	headerCount  int = 0
 )
 
-func UpdateData() {
+func printConsoleData() {
 	var msg []string
-	for _, s := range sensors {
-		sensorData := s.Update()
-		for i, d := range sensorData {
-			data[i] = d
-			setExportValue(i, s.GetSensorName())
-		}
-		msg = append(msg, s.GetConsoleData())
+	for _, p := range getPollers() {
+		msg = append(msg, p.consoleData())
 	}
 	if headerCount == 0 {
-		if outputStdout != 0 {
-			log.Println(headerData)
-		}
+		log.Println(headerData)
 	}
 	headerCount = (headerCount + 1) % 15
-	if outputStdout != 0 {
-		log.Println("|" + strings.Join(msg, "|") + "|")
-	}
+	log.Println("|" + strings.Join(msg, "|") + "|")
 }
 
 func main() {
+	// sensor-exporter check-config [file]
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		path := "/etc/sensor-exporter/sensor-exporter.conf"
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		os.Exit(runCheckConfig(path))
+	}
+
+	// sensor-exporter <driver> <command> [args], e.g. mhz19c calibrate-zero
+	if len(os.Args) > 1 {
+		if _, err := sensor.LookupDriver(os.Args[1]); err == nil {
+			os.Exit(runSensorCommand(os.Args[1], os.Args[2:]))
+		}
+	}
+
 	// parse arguments
 	flag.IntVar(&outputStdout, "stdout", 0, "1: output sensor data to stdout, 0: do not it")
 	flag.StringVar(&confPath, "config", "/etc/sensor-exporter/sensor-exporter.conf", "config file")
+	flag.BoolVar(&listDrivers, "list-drivers", false, "print available sensor drivers and their config keys, then exit")
 	flag.Parse()
 
+	if listDrivers {
+		printDrivers()
+		return
+	}
+
 	// make channel for stop application
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
 	// init configuration data
 	err := config.Init(confPath)
@@ -65,63 +79,94 @@ func main() {
 	config.DumpConfig()
 	conf = config.GetConfig().Default
 
-	// init metrics
-	data = make(map[string]float64, len(conf.ExportMetrics))
-	for _, s := range conf.ExportMetrics {
-		data[s] = 0.0
-	}
+	// define a function for stop application
+	defer func() {
+		stopExporter()
+		close(sig)
+	}()
 
-	// init sensors and stdout header string
-	sensors = sensor.Init(conf.EnabledSensors)
-	tmpHeaderData := make([]string, len(sensors))
-	for i, s := range sensors {
-		initerr := s.Init()
-		if initerr != nil {
-			log.Printf("sensor init error: %v\n", initerr)
-			os.Exit(1)
-		}
-		tmpHeaderData[i] = s.GetConsoleHeader()
+	// create a poller per sensor, each with its own poll interval
+	if err := initSensors(); err != nil {
+		log.Printf("sensor init error: %v\n", err)
+		os.Exit(1)
 	}
-	headerData = "|" + strings.Join(tmpHeaderData, "|") + "|"
 
 	// init prometheus exporter
 	initExporter()
 
-	// define a function for stop application
-	defer func() {
-		for _, s := range sensors {
-			s.Close()
-		}
-		stopExporter()
-		close(sig)
-	}()
+	// start the outputs sending the readings to other systems
+	if err := initOutputs(); err != nil {
+		log.Printf("output init error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// start the pollers. They init the sensors and retry the ones that fail.
+	for _, p := range getPollers() {
+		p.start()
+	}
+
+	// run prometheus exporter
+	go runExporter()
 
-	// init ticker for update metrics every 1 sec
+	// print sensor data to stdout every 1 sec until the application stops
 	ticker := time.NewTicker(1 * time.Second)
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		flag := true
-		for {
-			select {
-			case s := <-sig:
-				log.Printf("Received signal: %v\n", s)
-				flag = false
-			case <-ticker.C:
-				UpdateData()
+	running := true
+	for running {
+		select {
+		case s := <-sig:
+			log.Printf("Received signal: %v\n", s)
+			if s == syscall.SIGHUP {
+				if err := reloadConfig(); err != nil {
+					log.Printf("Config reload error: %v\n", err)
+				}
+				continue
 			}
-			if !flag {
-				break
+			running = false
+		case errCh := <-reloadCh:
+			errCh <- reloadConfig()
+		case <-ticker.C:
+			if outputStdout != 0 {
+				printConsoleData()
 			}
 		}
-		wg.Done()
-	}()
-
-	// run prometheus exporter
-	go runExporter()
+	}
+	ticker.Stop()
 
 	// wait to stop update metrics
-	wg.Wait()
+	stopPollers(getPollers())
+	stopOutputs()
 
 	log.Println("Stop application")
 }
+
+func printDrivers() {
+	fmt.Println("keys of all drivers:")
+	for _, k := range sensor.CommonConfigKeys {
+		printConfigKey(k)
+	}
+	for _, d := range sensor.Drivers() {
+		fmt.Printf("%s: %s\n", d.Name, d.Description)
+		for _, k := range d.ConfigKeys {
+			printConfigKey(k)
+		}
+	}
+	fmt.Println("outputs, configured in the section of their name:")
+	for _, d := range output.Drivers() {
+		fmt.Printf("%s: %s\n", d.Name, d.Description)
+		for _, k := range d.ConfigKeys {
+			printConfigKey(k)
+		}
+	}
+}
+
+func printConfigKey(k sensor.ConfigKey) {
+	kind := k.Kind
+	if kind == "" {
+		kind = sensor.KindString
+	}
+	name := k.Name
+	if k.Prefix {
+		name += "<metrics>"
+	}
+	fmt.Printf("    %-20s %-9s %-14s %s\n", name, kind, "("+k.Default+")", k.Help)
+}
@@ -0,0 +1,241 @@
+package output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Buffer is a bounded queue of records an output could not send yet. It is
+// kept in a file so that it survives restarts, or only in memory if the
+// path is empty. The oldest records are dropped when it grows beyond its
+// maximum size.
+//
+// The file starts with the 8 byte big endian offset of its first record,
+// followed by the records with a 4 byte big endian length. Records taken
+// from the front only move that offset, and are removed from the file once
+// they make up half of it.
+//
+// A file must have a single Buffer at a time: OpenBuffer rewrites it, and
+// the Buffer keeps the offsets of the records in memory. An output sink
+// closes its Buffer in Close, which must return before another sink opens
+// the same file, see Start.
+type Buffer struct {
+	mu      sync.Mutex
+	path    string
+	max     int64
+	records [][]byte
+	size    int64 // bytes of the records in memory
+	removed int64 // bytes of taken records still in the file
+	file    *os.File
+}
+
+const buffer_header = 8
+
+// OpenBuffer loads the records left in path by a previous run.
+func OpenBuffer(path string, max int64) (*Buffer, error) {
+	b := &Buffer{path: path, max: max}
+	if path == "" {
+		return b, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err == nil {
+		var head uint64
+		if err := binary.Read(f, binary.BigEndian, &head); err == nil && head > buffer_header {
+			f.Seek(int64(head), io.SeekStart)
+		}
+		r := bufio.NewReader(f)
+		for {
+			var n uint32
+			if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+				break
+			}
+			rec := make([]byte, n)
+			if _, err := io.ReadFull(r, rec); err != nil {
+				// the last record was cut short by a crash
+				break
+			}
+			b.records = append(b.records, rec)
+			b.size += int64(len(rec)) + 4
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for b.size > b.max && len(b.records) > 0 {
+		b.drop()
+	}
+	return b, b.rewrite()
+}
+
+// Push adds a record at the end and returns how many old records were
+// dropped to make room for it.
+func (b *Buffer) Push(rec []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if int64(len(rec))+4 > b.max {
+		return 1, nil
+	}
+	dropped := 0
+	for b.size+int64(len(rec))+4 > b.max {
+		b.drop()
+		dropped++
+	}
+	if b.path == "" {
+		b.records = append(b.records, rec)
+		b.size += int64(len(rec)) + 4
+		return dropped, nil
+	}
+	err := b.append(rec)
+	b.records = append(b.records, rec)
+	b.size += int64(len(rec)) + 4
+	if err != nil {
+		return dropped, err
+	}
+	if dropped > 0 {
+		return dropped, b.removeFront()
+	}
+	return dropped, nil
+}
+
+// PeekN returns up to n records from the front.
+func (b *Buffer) PeekN(n int) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > len(b.records) {
+		n = len(b.records)
+	}
+	return append([][]byte{}, b.records[:n]...)
+}
+
+// PopN removes up to n records from the front, once they were sent.
+func (b *Buffer) PopN(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.records) == 0 {
+		return nil
+	}
+	for ; n > 0 && len(b.records) > 0; n-- {
+		b.drop()
+	}
+	if b.path == "" {
+		return nil
+	}
+	return b.removeFront()
+}
+
+// Len returns the number of records.
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.records)
+}
+
+// Close closes the file, keeping the records for the next run.
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+// drop must be called with the lock held.
+func (b *Buffer) drop() {
+	n := int64(len(b.records[0])) + 4
+	b.records[0] = nil
+	b.records = b.records[1:]
+	b.size -= n
+	b.removed += n
+}
+
+// removeFront removes the dropped records from the file by moving its head
+// offset, and compacts the file once they make up half of it. It must be
+// called with the lock held.
+func (b *Buffer) removeFront() error {
+	if len(b.records) == 0 || b.removed > b.size {
+		return b.rewrite()
+	}
+	if err := b.open(); err != nil {
+		return err
+	}
+	var head [buffer_header]byte
+	binary.BigEndian.PutUint64(head[:], uint64(buffer_header+b.removed))
+	_, err := b.file.WriteAt(head[:], 0)
+	return err
+}
+
+// append writes rec after the records in the file. It must be called with
+// the lock held, before rec is added to the records in memory.
+func (b *Buffer) append(rec []byte) error {
+	if err := b.open(); err != nil {
+		return err
+	}
+	buf := make([]byte, 4, len(rec)+4)
+	binary.BigEndian.PutUint32(buf, uint32(len(rec)))
+	_, err := b.file.WriteAt(append(buf, rec...), buffer_header+b.removed+b.size)
+	return err
+}
+
+// open opens the file, writing its header if it is new. It must be called
+// with the lock held.
+func (b *Buffer) open() error {
+	if b.file != nil {
+		return nil
+	}
+	f, err := os.OpenFile(b.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err != nil || info.Size() < buffer_header {
+		var head [buffer_header]byte
+		binary.BigEndian.PutUint64(head[:], buffer_header)
+		if _, err := f.WriteAt(head[:], 0); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	b.file = f
+	return nil
+}
+
+// rewrite replaces the file by the records in memory. It must be called with
+// the lock held.
+func (b *Buffer) rewrite() error {
+	if b.path == "" {
+		return nil
+	}
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+	b.removed = 0
+	if len(b.records) == 0 {
+		if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	buf := make([]byte, buffer_header, buffer_header+b.size)
+	binary.BigEndian.PutUint64(buf, buffer_header)
+	for _, rec := range b.records {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(rec)))
+		buf = append(append(buf, n[:]...), rec...)
+	}
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
@@ -0,0 +1,141 @@
+package output
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func record(i int) []byte {
+	return []byte(fmt.Sprintf("record %04d", i)) // 11 bytes, 15 in the file
+}
+
+func contents(b *Buffer) []string {
+	var list []string
+	for _, rec := range b.PeekN(b.Len()) {
+		list = append(list, string(rec))
+	}
+	return list
+}
+
+func TestBufferReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.buffer")
+	b, err := OpenBuffer(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := b.Push(record(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.PopN(3); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// the taken records are not loaded again
+	b, err = OpenBuffer(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := contents(b)
+	if len(got) != 7 || got[0] != "record 0003" || got[6] != "record 0009" {
+		t.Errorf("reopened buffer = %q", got)
+	}
+
+	// nor a record cut short by a crash
+	b.Close()
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0, 0, 0, 11, 'r', 'e'})
+	f.Close()
+	b, err = OpenBuffer(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if n := b.Len(); n != 7 {
+		t.Errorf("%d records after a crash, want 7", n)
+	}
+
+	// the file is removed once empty
+	if err := b.PopN(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("empty buffer file kept: %v", err)
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.buffer")
+	b, err := OpenBuffer(path, 150) // 10 records
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i := 0; i < 10; i++ {
+		if n, err := b.Push(record(i)); n != 0 || err != nil {
+			t.Fatalf("Push %d = %d, %v", i, n, err)
+		}
+	}
+	info, _ := os.Stat(path)
+	for i := 10; i < 100; i++ {
+		if n, err := b.Push(record(i)); n != 1 || err != nil {
+			t.Fatalf("Push %d to a full buffer = %d, %v, want 1 dropped", i, n, err)
+		}
+		// the file is not rewritten on every push, but it does not grow
+		// beyond twice the records either
+		next, _ := os.Stat(path)
+		if next.Size() > buffer_header+2*150+15 {
+			t.Fatalf("file grew to %d bytes", next.Size())
+		}
+		if i == 10 && !os.SameFile(info, next) {
+			t.Errorf("file rewritten by the first push to a full buffer")
+		}
+	}
+	got := contents(b)
+	if len(got) != 10 || got[0] != "record 0090" || got[9] != "record 0099" {
+		t.Errorf("buffer = %q", got)
+	}
+
+	b.Close()
+	b, err = OpenBuffer(path, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened := contents(b); fmt.Sprint(reopened) != fmt.Sprint(got) {
+		t.Errorf("reopened buffer = %q, want %q", reopened, got)
+	}
+
+	// a smaller maximum drops the oldest records on open
+	b.Close()
+	b, err = OpenBuffer(path, 45)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(b); len(got) != 3 || got[0] != "record 0097" {
+		t.Errorf("buffer shrunk to %q", got)
+	}
+}
+
+func TestBufferInMemory(t *testing.T) {
+	b, err := OpenBuffer("", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		b.Push(record(i))
+	}
+	if n, _ := b.Push(make([]byte, 27)); n != 1 {
+		t.Errorf("Push of a record larger than the buffer = %d, want 1", n)
+	}
+	if got := contents(b); len(got) != 2 || got[0] != "record 0001" {
+		t.Errorf("buffer = %q", got)
+	}
+	b.PopN(1)
+	if got := contents(b); len(got) != 1 || got[0] != "record 0002" {
+		t.Errorf("buffer after PopN = %q", got)
+	}
+}
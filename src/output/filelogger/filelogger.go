@@ -0,0 +1,567 @@
+package filelogger
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+	"sensor-exporter/sensor"
+)
+
+const (
+	queue_size    = 1000
+	close_timeout = 10 * time.Second
+	// a CSV file up to this size gets a new header when a metric shows up,
+	// a larger one is rotated instead of rewritten
+	rewrite_max_size = 1 << 20
+	time_format      = "2006-01-02T15:04:05.000Z07:00"
+	rotated_format   = "20060102T150405"
+)
+
+func init() {
+	output.Register(output.Driver{
+		Name:        "file_logger",
+		Description: "log the readings to a CSV or JSON Lines file with rotation",
+		ConfigKeys: []sensor.ConfigKey{
+			{Name: "path", Default: "/var/log/sensor-exporter/readings.csv", Help: "file the readings are appended to"},
+			{Name: "format", Default: "csv", Help: "csv with a column per metrics or jsonl with a field per metrics", Check: sensor.OneOf("csv", "jsonl")},
+			{Name: "utc", Default: "false", Help: "write the timestamps and rotate in UTC instead of the local time", Kind: sensor.KindBool},
+			{Name: "flush_interval", Default: "10s", Help: "interval between two writes of the file", Kind: sensor.KindDuration, Check: sensor.Positive},
+			{Name: "rotate_size", Default: "10485760", Help: "rotate the file when it reaches this size in bytes, 0 to disable", Kind: sensor.KindInt, Check: sensor.IntRange(0, math.MaxInt64)},
+			{Name: "rotate_interval", Default: "24h", Help: "rotate the file at this interval from midnight, 0 to disable", Kind: sensor.KindDuration},
+			{Name: "compress", Default: "true", Help: "gzip the rotated files", Kind: sensor.KindBool},
+			{Name: "max_files", Default: "30", Help: "rotated files kept, 0 to keep all", Kind: sensor.KindInt, Check: sensor.IntRange(0, math.MaxInt32)},
+			{Name: "max_age", Default: "0", Help: "remove rotated files older than this, 0 to keep them", Kind: sensor.KindDuration},
+		},
+		New: func() (output.Sink, error) { return New(config.GetConfig().FileLogger) },
+	})
+}
+
+// Sink appends a line per reading to a file. In CSV, the columns are the
+// timestamp, the sensor and its name followed by the metrics of every
+// sensor in the order they showed up, empty for the metrics of other
+// sensors.
+type Sink struct {
+	conf     config.FileLogger
+	readings chan output.Reading
+	quit     chan struct{}
+	done     chan struct{}
+
+	dropMu  sync.Mutex
+	dropped int
+
+	// owned by run
+	file      *os.File
+	w         *bufio.Writer
+	size      int64
+	columns   []string
+	known     map[string]bool
+	start     time.Time // of the first reading in the file
+	periodEnd time.Time
+}
+
+// New returns a running sink configured by conf, appending to the file
+// left by a previous run.
+func New(conf config.FileLogger) (*Sink, error) {
+	if conf.Path == "" {
+		return nil, fmt.Errorf("file_logger: path is required")
+	}
+	s := &Sink{
+		conf:     conf,
+		readings: make(chan output.Reading, queue_size),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		known:    map[string]bool{},
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.Path), 0755); err != nil {
+		return nil, fmt.Errorf("file_logger: %v", err)
+	}
+	if err := s.open(); err != nil {
+		return nil, fmt.Errorf("file_logger: %v", err)
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *Sink) Write(r output.Reading) {
+	select {
+	case s.readings <- r:
+	default:
+		s.dropMu.Lock()
+		if s.dropped == 0 {
+			log.Printf("File logger queue is full, dropping readings\n")
+		}
+		s.dropped++
+		s.dropMu.Unlock()
+	}
+}
+
+func (s *Sink) SetHealth(instance, sensorName string, up bool) {}
+
+// Close writes the queued readings and closes the file.
+func (s *Sink) Close() {
+	close(s.quit)
+	select {
+	case <-s.done:
+	case <-time.After(close_timeout):
+		log.Printf("File logger did not stop in %v\n", close_timeout)
+	}
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	s.cleanup(time.Now())
+	ticker := time.NewTicker(s.conf.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			for len(s.readings) > 0 {
+				s.write(<-s.readings)
+			}
+			if err := s.closeFile(); err != nil {
+				log.Printf("File logger write error: %v\n", err)
+			}
+			return
+		case r := <-s.readings:
+			s.write(r)
+		case <-ticker.C:
+			if s.w != nil {
+				if err := s.w.Flush(); err != nil {
+					log.Printf("File logger write error: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+func (s *Sink) now(t time.Time) time.Time {
+	if s.conf.Utc {
+		return t.UTC()
+	}
+	return t.Local()
+}
+
+// open opens the file for appending, reading the columns of an existing
+// CSV file.
+func (s *Sink) open() error {
+	fi, err := os.Stat(s.conf.Path)
+	if err == nil {
+		if s.conf.Format == "csv" && fi.Size() > 0 {
+			if err := s.readHeader(); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(s.conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	s.size = 0
+	s.start = time.Time{}
+	s.periodEnd = time.Time{}
+	if fi != nil && fi.Size() > 0 {
+		s.size = fi.Size()
+		start, ok := s.firstTime()
+		if !ok {
+			start = fi.ModTime()
+		}
+		s.setStart(s.now(start))
+	}
+	return nil
+}
+
+// firstTime returns the timestamp of the first reading in the file.
+func (s *Sink) firstTime() (time.Time, bool) {
+	f, err := os.Open(s.conf.Path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+	var ts string
+	if s.conf.Format == "jsonl" {
+		var line struct{ Timestamp string }
+		if err := json.NewDecoder(f).Decode(&line); err != nil {
+			return time.Time{}, false
+		}
+		ts = line.Timestamp
+	} else {
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		if _, err := r.Read(); err != nil {
+			return time.Time{}, false
+		}
+		row, err := r.Read()
+		if err != nil {
+			return time.Time{}, false
+		}
+		ts = row[0]
+	}
+	t, err := time.Parse(time_format, ts)
+	return t, err == nil
+}
+
+// setStart sets the time of the first reading in the file, which starts its
+// rotation interval.
+func (s *Sink) setStart(t time.Time) {
+	s.start = t
+	s.periodEnd = s.nextRotation(t)
+}
+
+func (s *Sink) readHeader() error {
+	f, err := os.Open(s.conf.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header, err := csv.NewReader(f).Read()
+	if err != nil || len(header) < 3 || header[0] != "timestamp" {
+		return fmt.Errorf("%s has no header of the file logger, move it away", s.conf.Path)
+	}
+	s.columns = append([]string{}, header[3:]...)
+	for _, c := range s.columns {
+		s.known[c] = true
+	}
+	return nil
+}
+
+func (s *Sink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	s.w = nil
+	return err
+}
+
+// nextRotation returns the end of the rotation interval containing t,
+// counted from midnight, or the zero time if time based rotation is off.
+func (s *Sink) nextRotation(t time.Time) time.Time {
+	if s.conf.RotateInterval <= 0 {
+		return time.Time{}
+	}
+	return s.periodStart(t).Add(s.conf.RotateInterval)
+}
+
+// periodStart returns the start of the rotation interval containing t, or
+// t if time based rotation is off.
+func (s *Sink) periodStart(t time.Time) time.Time {
+	if s.conf.RotateInterval <= 0 {
+		return t
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	n := t.Sub(midnight) / s.conf.RotateInterval
+	return midnight.Add(n * s.conf.RotateInterval)
+}
+
+func (s *Sink) write(r output.Reading) {
+	if s.file == nil {
+		// the file could not be opened after the last rotation
+		if err := s.open(); err != nil {
+			return
+		}
+	}
+	t := s.now(r.Time)
+	if !s.periodEnd.IsZero() && !t.Before(s.periodEnd) && s.size > 0 {
+		s.rotate(t)
+	}
+	if s.start.IsZero() {
+		s.setStart(t)
+	}
+	var line []byte
+	var err error
+	if s.conf.Format == "jsonl" {
+		line = jsonLine(r, t)
+	} else if line, err = s.csvLine(r, t); err != nil {
+		log.Printf("File logger write error: %v\n", err)
+		return
+	}
+	if s.file == nil {
+		return
+	}
+	n, err := s.w.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		log.Printf("File logger write error: %v\n", err)
+		return
+	}
+	if s.conf.RotateSize > 0 && s.size >= s.conf.RotateSize {
+		s.rotate(t)
+	}
+}
+
+func metricNames(values map[string]float64) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func formatValue(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func jsonLine(r output.Reading, t time.Time) []byte {
+	var b bytes.Buffer
+	str := func(s string) string {
+		q, _ := json.Marshal(s)
+		return string(q)
+	}
+	b.WriteString(`{"timestamp":` + str(t.Format(time_format)))
+	b.WriteString(`,"sensor":` + str(r.Instance))
+	b.WriteString(`,"sensor_name":` + str(r.SensorName))
+	for _, name := range metricNames(r.Values) {
+		v := formatValue(r.Values[name])
+		if v == "" {
+			v = "null"
+		}
+		b.WriteString("," + str(name) + ":" + v)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+func (s *Sink) csvLine(r output.Reading, t time.Time) ([]byte, error) {
+	added := []string{}
+	for _, name := range metricNames(r.Values) {
+		if !s.known[name] {
+			added = append(added, name)
+		}
+	}
+	if len(added) > 0 {
+		if err := s.addColumns(added, t); err != nil {
+			return nil, err
+		}
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if s.size == 0 {
+		w.Write(append([]string{"timestamp", "sensor", "sensor_name"}, s.columns...))
+	}
+	row := []string{t.Format(time_format), r.Instance, r.SensorName}
+	for _, c := range s.columns {
+		v, ok := r.Values[c]
+		if !ok {
+			row = append(row, "")
+			continue
+		}
+		row = append(row, formatValue(v))
+	}
+	w.Write(row)
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+// addColumns adds metrics columns. A file with rows gets the new header if
+// it is small, e.g. while the sensors report their first readings, and is
+// rotated otherwise.
+func (s *Sink) addColumns(added []string, t time.Time) error {
+	old := len(s.columns)
+	s.columns = append(s.columns, added...)
+	for _, c := range added {
+		s.known[c] = true
+	}
+	if s.size == 0 {
+		return nil
+	}
+	if s.size > rewrite_max_size {
+		s.rotate(t)
+		return nil
+	}
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(s.conf.Path)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(append([]string{"timestamp", "sensor", "sensor_name"}, s.columns...))
+	w.Flush()
+	pad := strings.Repeat(",", len(s.columns)-old)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for _, line := range lines[1:] {
+		if len(line) == 0 {
+			continue
+		}
+		b.Write(bytes.TrimSuffix(line, []byte("\n")))
+		b.WriteString(pad + "\n")
+	}
+	tmp := s.conf.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.conf.Path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// rotate moves the file aside, named by the start of its rotation interval
+// with a suffix -1, -2, ... for the files rotated by size within it, then
+// compresses it and removes the rotated files beyond the retention.
+func (s *Sink) rotate(t time.Time) {
+	if err := s.closeFile(); err != nil {
+		log.Printf("File logger write error: %v\n", err)
+	}
+	start := s.start
+	if start.IsZero() {
+		start = t
+	}
+	ext := filepath.Ext(s.conf.Path)
+	prefix := strings.TrimSuffix(s.conf.Path, ext) + "-"
+	period := s.periodStart(start)
+	base := prefix + period.Format(rotated_format)
+	// after the last file of the interval, even if older ones were removed
+	last := -1
+	matches, _ := filepath.Glob(base + "*")
+	for _, path := range matches {
+		if pt, n, ok := parseRotated(strings.TrimPrefix(path, prefix), ext); ok && pt.Format(rotated_format) == period.Format(rotated_format) && n > last {
+			last = n
+		}
+	}
+	rotated := base + ext
+	if last >= 0 {
+		rotated = base + "-" + strconv.Itoa(last+1) + ext
+	}
+	if err := os.Rename(s.conf.Path, rotated); err != nil {
+		log.Printf("File logger rotation error: %v\n", err)
+	}
+	if err := s.open(); err != nil {
+		log.Printf("File logger error: %v\n", err)
+	}
+	s.cleanup(t)
+}
+
+// cleanup compresses the rotated files, including ones left uncompressed by
+// a crash, and removes the ones beyond max_files or max_age.
+func (s *Sink) cleanup(now time.Time) {
+	ext := filepath.Ext(s.conf.Path)
+	prefix := strings.TrimSuffix(s.conf.Path, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return
+	}
+	rotated := []string{}
+	for _, path := range matches {
+		if _, _, ok := parseRotated(strings.TrimPrefix(path, prefix), ext); !ok {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(path, ext):
+			if s.conf.Compress {
+				if err := compress(path); err != nil {
+					log.Printf("File logger compression error: %v\n", err)
+					rotated = append(rotated, path)
+					continue
+				}
+				path += ".gz"
+			}
+			rotated = append(rotated, path)
+		case strings.HasSuffix(path, ext+".gz"):
+			rotated = append(rotated, path)
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		ti, ni, _ := parseRotated(strings.TrimPrefix(rotated[i], prefix), ext)
+		tj, nj, _ := parseRotated(strings.TrimPrefix(rotated[j], prefix), ext)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return ni < nj
+	})
+	for i, path := range rotated {
+		remove := s.conf.MaxFiles > 0 && i < len(rotated)-s.conf.MaxFiles
+		if fi, err := os.Stat(path); err == nil && s.conf.MaxAge > 0 && now.Sub(fi.ModTime()) > s.conf.MaxAge {
+			remove = true
+		}
+		if remove {
+			if err := os.Remove(path); err != nil {
+				log.Printf("File logger retention error: %v\n", err)
+			}
+		}
+	}
+}
+
+// parseRotated returns the time and suffix of the name of a rotated file
+// without its prefix, such as 20231017T000000-1.csv.gz.
+func parseRotated(name, ext string) (time.Time, int, bool) {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ext)
+	n := 0
+	if i := strings.IndexByte(name, '-'); i >= 0 {
+		var err error
+		if n, err = strconv.Atoi(name[i+1:]); err != nil || n < 1 {
+			return time.Time{}, 0, false
+		}
+		name = name[:i]
+	}
+	t, err := time.Parse(rotated_format, name)
+	return t, n, err == nil
+}
+
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	zw.ModTime = fi.ModTime()
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// keep the time of the data for max_age
+	os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,129 @@
+package filelogger
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+)
+
+var day = time.Date(2023, 10, 17, 0, 0, 0, 0, time.UTC)
+
+func testConf(dir string) config.FileLogger {
+	return config.FileLogger{
+		Path:           filepath.Join(dir, "readings.csv"),
+		Format:         "csv",
+		Utc:            true,
+		FlushInterval:  time.Hour,
+		RotateInterval: 24 * time.Hour,
+	}
+}
+
+func reading(t time.Time, temp float64) output.Reading {
+	return output.Reading{Instance: "bme280", SensorName: "BME280", Values: map[string]float64{"temperature": temp}, Time: t}
+}
+
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range list {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotateByInterval(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(testConf(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(reading(day.Add(10*time.Hour), 21))
+	s.Write(reading(day.Add(23*time.Hour), 22))
+	// the next day goes to a new file, the old one is named by its day
+	s.Write(reading(day.Add(25*time.Hour), 23))
+	s.Close()
+
+	want := []string{"readings-20231017T000000.csv", "readings.csv"}
+	if got := files(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, want[0]))
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 ||
+		lines[1] != "2023-10-17T10:00:00.000Z,bme280,BME280,21" {
+		t.Errorf("rotated file = %q", data)
+	}
+
+	// after a restart, the readings of another day rotate the file left
+	// behind by the day of its first reading
+	s, err = New(testConf(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(reading(day.Add(49*time.Hour), 24))
+	s.Close()
+	want = []string{"readings-20231017T000000.csv", "readings-20231018T000000.csv", "readings.csv"}
+	if got := files(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("files after a restart = %v, want %v", got, want)
+	}
+}
+
+func TestRotateBySizeKeepsNewest(t *testing.T) {
+	dir := t.TempDir()
+	conf := testConf(dir)
+	conf.RotateSize = 100 // about 2 readings
+	conf.Compress = true
+	conf.MaxFiles = 3
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		s.Write(reading(day.Add(time.Duration(i)*time.Minute), float64(i)))
+	}
+	s.Close()
+
+	// rotated in the same interval, the files get suffixes, and the newest
+	// ones are kept although readings-20231017T000000.csv.gz sorts last
+	got := files(t, dir)
+	want := []string{
+		"readings-20231017T000000-12.csv.gz",
+		"readings-20231017T000000-13.csv.gz",
+		"readings-20231017T000000-14.csv.gz",
+		"readings.csv",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+}
+
+func TestParseRotated(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		n    int
+		ok   bool
+	}{
+		{"20231017T000000.csv", 0, true},
+		{"20231017T000000-1.csv.gz", 1, true},
+		{"20231017T000000-12.csv", 12, true},
+		{"20231017T000000-x.csv", 0, false},
+		{"20231017T000000-0.csv", 0, false},
+		{"backup.csv", 0, false},
+		{"20231017T000000.csv.gz.tmp", 0, false},
+	} {
+		ts, n, ok := parseRotated(tc.name, ".csv")
+		if ok != tc.ok || n != tc.n || (ok && !ts.Equal(day)) {
+			t.Errorf("parseRotated(%q) = %v, %d, %v", tc.name, ts, n, ok)
+		}
+	}
+}
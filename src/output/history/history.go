@@ -0,0 +1,165 @@
+package history
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+	"sensor-exporter/sensor"
+)
+
+const (
+	queue_size       = 1000
+	compact_interval = time.Hour
+	close_timeout    = 10 * time.Second
+)
+
+var (
+	currentMu sync.Mutex
+	current   *Sink
+)
+
+func init() {
+	output.Register(output.Driver{
+		Name:        "history",
+		Description: "keep the readings on the device, queried on /api/v1/history",
+		ConfigKeys: []sensor.ConfigKey{
+			{Name: "dir", Default: "<state_dir>/history", Help: "directory of the history files"},
+			{Name: "raw_retention", Default: "24h", Help: "how long every reading is kept", Kind: sensor.KindDuration, Check: sensor.Positive},
+			{Name: "downsample", Default: "5m:720h, 1h:8760h", Help: "comma separated step:retention tiers keeping min, max and avg per step", Check: checkTiers},
+			{Name: "flush_interval", Default: "1m", Help: "interval between two writes of the files", Kind: sensor.KindDuration, Check: sensor.Positive},
+			{Name: "max_points", Default: "10000", Help: "maximum number of points or buckets returned by a query", Kind: sensor.KindInt, Check: sensor.Positive},
+		},
+		New: func() (output.Sink, error) { return New(config.GetConfig().History) },
+	})
+}
+
+func checkTiers(value string) error {
+	_, err := ParseTiers(value)
+	return err
+}
+
+// Current returns the store of the running history, or nil if the history
+// is not enabled.
+func Current() *Store {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if current == nil {
+		return nil
+	}
+	return current.store
+}
+
+// Sink adds the readings to a Store, writing it every flush interval and
+// dropping the records beyond the retention every hour.
+type Sink struct {
+	conf     config.History
+	store    *Store
+	readings chan output.Reading
+	quit     chan struct{}
+	done     chan struct{}
+
+	dropMu  sync.Mutex
+	dropped int
+}
+
+// New returns a running sink configured by conf, which becomes the
+// current history.
+func New(conf config.History) (*Sink, error) {
+	if conf.Dir == "" {
+		return nil, fmt.Errorf("history: dir is required")
+	}
+	tiers, err := ParseTiers(conf.Downsample)
+	if err != nil {
+		return nil, fmt.Errorf("history: downsample: %v", err)
+	}
+	store, err := Open(conf.Dir, conf.RawRetention, tiers)
+	if err != nil {
+		return nil, fmt.Errorf("history: %v", err)
+	}
+	s := &Sink{
+		conf:     conf,
+		store:    store,
+		readings: make(chan output.Reading, queue_size),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	currentMu.Lock()
+	current = s
+	currentMu.Unlock()
+	go s.run()
+	return s, nil
+}
+
+func (s *Sink) Write(r output.Reading) {
+	select {
+	case s.readings <- r:
+	default:
+		s.dropMu.Lock()
+		if s.dropped == 0 {
+			log.Printf("History queue is full, dropping readings\n")
+		}
+		s.dropped++
+		s.dropMu.Unlock()
+	}
+}
+
+func (s *Sink) SetHealth(instance, sensorName string, up bool) {}
+
+// Close writes the history, including the buckets in progress, and stops
+// the sink.
+func (s *Sink) Close() {
+	currentMu.Lock()
+	if current == s {
+		current = nil
+	}
+	currentMu.Unlock()
+	close(s.quit)
+	select {
+	case <-s.done:
+	case <-time.After(close_timeout):
+		log.Printf("History did not stop in %v\n", close_timeout)
+	}
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	if err := s.store.Compact(time.Now()); err != nil {
+		log.Printf("History compaction error: %v\n", err)
+	}
+	flush := time.NewTicker(s.conf.FlushInterval)
+	defer flush.Stop()
+	compact := time.NewTicker(compact_interval)
+	defer compact.Stop()
+	for {
+		select {
+		case <-s.quit:
+			for len(s.readings) > 0 {
+				s.add(<-s.readings)
+			}
+			if err := s.store.Flush(true); err != nil {
+				log.Printf("History write error: %v\n", err)
+			}
+			return
+		case r := <-s.readings:
+			s.add(r)
+		case <-flush.C:
+			if err := s.store.Flush(false); err != nil {
+				log.Printf("History write error: %v\n", err)
+			}
+		case now := <-compact.C:
+			if err := s.store.Compact(now); err != nil {
+				log.Printf("History compaction error: %v\n", err)
+			}
+		}
+	}
+}
+
+func (s *Sink) add(r output.Reading) {
+	for metric, value := range r.Values {
+		s.store.Add(r.Instance, metric, r.Time, value)
+	}
+}
@@ -0,0 +1,573 @@
+package history
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record sizes of the files. Raw files hold a timestamp in milliseconds and
+// a value; downsampled files hold the start of a bucket and the min, max,
+// sum and count of the values in it. All fields are little endian.
+const (
+	raw_record_size = 16
+	agg_record_size = 40
+)
+
+// Tier is a resolution at which the history is kept. The raw tier has a
+// step of zero and keeps every reading.
+type Tier struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+func (t Tier) ext() string {
+	if t.Step == 0 {
+		return ".raw"
+	}
+	return "." + strconv.FormatInt(int64(t.Step/time.Second), 10) + "s"
+}
+
+func (t Tier) recordSize() int64 {
+	if t.Step == 0 {
+		return raw_record_size
+	}
+	return agg_record_size
+}
+
+// ParseTiers parses the downsampled tiers, comma separated step:retention
+// pairs such as "5m:720h, 1h:8760h". Steps are whole seconds and each one a
+// multiple of the previous one.
+func ParseTiers(s string) ([]Tier, error) {
+	tiers := []Tier{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not step:retention", pair)
+		}
+		step, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		retention, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if step < time.Second || step%time.Second != 0 || retention < step {
+			return nil, fmt.Errorf("%q needs a step of whole seconds and a retention of at least the step", pair)
+		}
+		if len(tiers) > 0 && step%tiers[len(tiers)-1].Step != 0 {
+			return nil, fmt.Errorf("%q: step is not a multiple of the previous step", pair)
+		}
+		tiers = append(tiers, Tier{Step: step, Retention: retention})
+	}
+	return tiers, nil
+}
+
+// Point is a raw reading.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Bucket aggregates the readings from Time to Time plus the step.
+type Bucket struct {
+	Time  time.Time
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count uint64
+}
+
+func (b *Bucket) add(o Bucket) {
+	if b.Count == 0 {
+		*b = Bucket{Time: b.Time, Min: o.Min, Max: o.Max}
+	}
+	b.Min = math.Min(b.Min, o.Min)
+	b.Max = math.Max(b.Max, o.Max)
+	b.Sum += o.Sum
+	b.Count += o.Count
+}
+
+// Store keeps the history of every metrics in a directory per sensor, with
+// an append-only file per metrics and tier. Appends are buffered in memory
+// until Flush.
+type Store struct {
+	mu     sync.Mutex
+	dir    string
+	tiers  []Tier // the raw tier first
+	series map[string]*series
+}
+
+type series struct {
+	files   []*tierFile
+	buckets []Bucket // current bucket of each downsampled tier
+}
+
+type tierFile struct {
+	path    string
+	tier    Tier
+	pending []byte
+	last    int64 // timestamp of the last record, -1 if not read yet
+}
+
+// Open returns a store in dir keeping raw readings for rawRetention and
+// the downsampled tiers.
+func Open(dir string, rawRetention time.Duration, tiers []Tier) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{
+		dir:    dir,
+		tiers:  append([]Tier{{Retention: rawRetention}}, tiers...),
+		series: map[string]*series{},
+	}, nil
+}
+
+func (s *Store) path(instance, metric string, t Tier) string {
+	return filepath.Join(s.dir, url.PathEscape(instance), url.PathEscape(metric)+t.ext())
+}
+
+// getSeries must be called with the lock held.
+func (s *Store) getSeries(instance, metric string) *series {
+	key := instance + "/" + metric
+	if sr, ok := s.series[key]; ok {
+		return sr
+	}
+	sr := &series{buckets: make([]Bucket, len(s.tiers)-1)}
+	for _, t := range s.tiers {
+		sr.files = append(sr.files, &tierFile{path: s.path(instance, metric, t), tier: t, last: -1})
+	}
+	s.series[key] = sr
+	return sr
+}
+
+// Add records a reading. Readings older than the last one of the metrics
+// are ignored, since the files are kept in time order.
+func (s *Store) Add(instance, metric string, t time.Time, value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sr := s.getSeries(instance, metric)
+	ms := t.UnixNano() / int64(time.Millisecond)
+	raw := sr.files[0]
+	if ms <= raw.lastTime() {
+		return
+	}
+	var rec [raw_record_size]byte
+	binary.LittleEndian.PutUint64(rec[0:], uint64(ms))
+	binary.LittleEndian.PutUint64(rec[8:], math.Float64bits(value))
+	raw.pending = append(raw.pending, rec[:]...)
+	raw.last = ms
+
+	for i := range sr.buckets {
+		f := sr.files[i+1]
+		step := int64(f.tier.Step / time.Millisecond)
+		start := ms - ms%step
+		b := &sr.buckets[i]
+		if b.Count > 0 && b.Time.UnixNano()/int64(time.Millisecond) != start {
+			f.appendBucket(*b)
+			*b = Bucket{}
+		}
+		if b.Count == 0 {
+			b.Time = time.Unix(0, start*int64(time.Millisecond))
+		}
+		b.add(Bucket{Min: value, Max: value, Sum: value, Count: 1})
+	}
+}
+
+// appendBucket queues b, merged into the last pending bucket if it has the
+// same start.
+func (f *tierFile) appendBucket(b Bucket) {
+	if n := len(f.pending); n >= agg_record_size {
+		last := f.pending[n-agg_record_size:]
+		if prev := decodeBucket(last); prev.Time.Equal(b.Time) {
+			prev.add(b)
+			encodeBucket(last, prev)
+			return
+		}
+	}
+	var rec [agg_record_size]byte
+	encodeBucket(rec[:], b)
+	f.pending = append(f.pending, rec[:]...)
+}
+
+func encodeBucket(rec []byte, b Bucket) {
+	binary.LittleEndian.PutUint64(rec[0:], uint64(b.Time.UnixNano()/int64(time.Millisecond)))
+	binary.LittleEndian.PutUint64(rec[8:], math.Float64bits(b.Min))
+	binary.LittleEndian.PutUint64(rec[16:], math.Float64bits(b.Max))
+	binary.LittleEndian.PutUint64(rec[24:], math.Float64bits(b.Sum))
+	binary.LittleEndian.PutUint64(rec[32:], b.Count)
+}
+
+func decodeBucket(rec []byte) Bucket {
+	return Bucket{
+		Time:  msTime(int64(binary.LittleEndian.Uint64(rec[0:]))),
+		Min:   math.Float64frombits(binary.LittleEndian.Uint64(rec[8:])),
+		Max:   math.Float64frombits(binary.LittleEndian.Uint64(rec[16:])),
+		Sum:   math.Float64frombits(binary.LittleEndian.Uint64(rec[24:])),
+		Count: binary.LittleEndian.Uint64(rec[32:]),
+	}
+}
+
+// lastTime returns the timestamp of the last record, reading it from the
+// file the first time.
+func (f *tierFile) lastTime() int64 {
+	if f.last >= 0 {
+		return f.last
+	}
+	f.last = 0
+	file, err := os.Open(f.path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	size := f.tier.recordSize()
+	if fi, err := file.Stat(); err == nil && fi.Size() >= size {
+		var ts [8]byte
+		if _, err := file.ReadAt(ts[:], (fi.Size()/size-1)*size); err == nil {
+			f.last = int64(binary.LittleEndian.Uint64(ts[:]))
+		}
+	}
+	return f.last
+}
+
+// Flush appends the pending records to the files. If partial is set, the
+// current buckets of the downsampled tiers are written as well, e.g. on
+// shutdown; a bucket continued after a restart is merged into the partial
+// one when it is written.
+func (s *Store) Flush(partial bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked(partial)
+}
+
+func (s *Store) flushLocked(partial bool) error {
+	var first error
+	for _, sr := range s.series {
+		if partial {
+			for i := range sr.buckets {
+				if sr.buckets[i].Count > 0 {
+					sr.files[i+1].appendBucket(sr.buckets[i])
+					sr.buckets[i] = Bucket{}
+				}
+			}
+		}
+		for _, f := range sr.files {
+			if err := f.flush(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (f *tierFile) flush() error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// a record cut short by a crash would shift every later one
+	end := fi.Size() - fi.Size()%f.tier.recordSize()
+	pending := f.pending
+	if f.tier.Step > 0 && end >= agg_record_size {
+		last := make([]byte, agg_record_size)
+		if _, err := file.ReadAt(last, end-agg_record_size); err != nil {
+			return err
+		}
+		if b := decodeBucket(last); b.Time.Equal(decodeBucket(pending).Time) {
+			b.add(decodeBucket(pending))
+			encodeBucket(last, b)
+			pending = append(last, pending[agg_record_size:]...)
+			end -= agg_record_size
+		}
+	}
+	if _, err := file.WriteAt(pending, end); err != nil {
+		return err
+	}
+	if err := file.Truncate(end + int64(len(pending))); err != nil {
+		return err
+	}
+	f.pending = f.pending[:0]
+	return nil
+}
+
+// Compact drops the records older than the retention of their tier.
+func (s *Store) Compact(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(false); err != nil {
+		return err
+	}
+	var first error
+	filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		for _, t := range s.tiers {
+			if strings.HasSuffix(path, t.ext()) {
+				if err := compactFile(path, t, now); err != nil && first == nil {
+					first = err
+				}
+			}
+		}
+		return nil
+	})
+	return first
+}
+
+func compactFile(path string, t Tier, now time.Time) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	cut := (now.Add(-t.Retention).UnixNano() / int64(time.Millisecond))
+	size := t.recordSize()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	n := fi.Size() / size
+	i, err := search(file, size, n, cut)
+	if err != nil || i == 0 {
+		return err
+	}
+	if i == n {
+		file.Close()
+		return os.Remove(path)
+	}
+	rest := make([]byte, (n-i)*size)
+	if _, err := file.ReadAt(rest, i*size); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, rest, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// search returns the index of the first of n records with a timestamp of at
+// least ms.
+func search(file io.ReaderAt, size, n, ms int64) (int64, error) {
+	var ts [8]byte
+	var err error
+	i := sort.Search(int(n), func(i int) bool {
+		if _, e := file.ReadAt(ts[:], int64(i)*size); e != nil {
+			err = e
+			return true
+		}
+		return int64(binary.LittleEndian.Uint64(ts[:])) >= ms
+	})
+	return int64(i), err
+}
+
+// Series returns the sensors and their metrics with a history.
+func (s *Store) Series() (map[string][]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(false); err != nil {
+		return nil, err
+	}
+	list := map[string][]string{}
+	dirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		instance, err := url.PathUnescape(d.Name())
+		if !d.IsDir() || err != nil {
+			continue
+		}
+		files, _ := ioutil.ReadDir(filepath.Join(s.dir, d.Name()))
+		for _, f := range files {
+			if !strings.HasSuffix(f.Name(), ".raw") {
+				continue
+			}
+			if metric, err := url.PathUnescape(strings.TrimSuffix(f.Name(), ".raw")); err == nil {
+				list[instance] = append(list[instance], metric)
+			}
+		}
+	}
+	return list, nil
+}
+
+// Points returns the raw readings from start to end.
+func (s *Store) Points(instance, metric string, start, end time.Time, limit int) ([]Point, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(false); err != nil {
+		return nil, err
+	}
+	points := []Point{}
+	err := s.scan(s.path(instance, metric, s.tiers[0]), s.tiers[0], start, end, func(rec []byte) bool {
+		if len(points) == limit {
+			return false
+		}
+		points = append(points, Point{
+			Time:  msTime(int64(binary.LittleEndian.Uint64(rec[0:]))),
+			Value: math.Float64frombits(binary.LittleEndian.Uint64(rec[8:])),
+		})
+		return true
+	})
+	return points, err
+}
+
+// Buckets aggregates the readings from start to end into buckets of step.
+// It reads the coarsest tier with a step dividing step that still covers
+// start, or the finest one covering start, and returns the step used, which
+// is larger than step if no finer tier covers start.
+func (s *Store) Buckets(instance, metric string, start, end time.Time, step time.Duration, now time.Time) ([]Bucket, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(false); err != nil {
+		return nil, 0, err
+	}
+	t := s.tierFor(start, step, now)
+	if t.Step > step {
+		step = t.Step
+	}
+	stepMs := int64(step / time.Millisecond)
+	buckets := []Bucket{}
+	add := func(ms int64, b Bucket) {
+		startMs := ms - ms%stepMs
+		if n := len(buckets); n == 0 || buckets[n-1].Time.UnixNano()/int64(time.Millisecond) != startMs {
+			buckets = append(buckets, Bucket{Time: msTime(startMs)})
+		}
+		buckets[len(buckets)-1].add(b)
+	}
+	err := s.scan(s.path(instance, metric, t), t, start, end, func(rec []byte) bool {
+		ms := int64(binary.LittleEndian.Uint64(rec[0:]))
+		if t.Step == 0 {
+			v := math.Float64frombits(binary.LittleEndian.Uint64(rec[8:]))
+			add(ms, Bucket{Min: v, Max: v, Sum: v, Count: 1})
+			return true
+		}
+		add(ms, decodeBucket(rec))
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	// the current buckets are not written yet
+	if t.Step > 0 {
+		if sr, ok := s.series[instance+"/"+metric]; ok {
+			for i, f := range sr.files[1:] {
+				if f.tier == t && sr.buckets[i].Count > 0 && !sr.buckets[i].Time.Before(start) && !sr.buckets[i].Time.After(end) {
+					add(sr.buckets[i].Time.UnixNano()/int64(time.Millisecond), sr.buckets[i])
+				}
+			}
+		}
+	}
+	return buckets, step, nil
+}
+
+// tierFor must be called with the lock held.
+func (s *Store) tierFor(start time.Time, step time.Duration, now time.Time) Tier {
+	var best, finest *Tier
+	for i := range s.tiers {
+		t := &s.tiers[i]
+		if now.Sub(start) > t.Retention {
+			continue
+		}
+		if t.Step <= step && step%maxDuration(t.Step, 1) == 0 {
+			best = t
+		}
+		if finest == nil {
+			finest = t
+		}
+	}
+	switch {
+	case best != nil:
+		return *best
+	case finest != nil:
+		return *finest
+	}
+	// nothing covers start, use the longest history
+	longest := s.tiers[0]
+	for _, t := range s.tiers {
+		if t.Retention > longest.Retention {
+			longest = t
+		}
+	}
+	return longest
+}
+
+// scan calls fn with the records from start to end until it returns false.
+func (s *Store) scan(path string, t Tier, start, end time.Time, fn func(rec []byte) bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := t.recordSize()
+	n := fi.Size() / size
+	startMs := start.UnixNano() / int64(time.Millisecond)
+	if t.Step > 0 {
+		// the bucket containing start
+		startMs -= startMs % int64(t.Step/time.Millisecond)
+	}
+	endMs := end.UnixNano() / int64(time.Millisecond)
+	i, err := search(file, size, n, startMs)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(file, i*size, (n-i)*size), 64<<10)
+	rec := make([]byte, size)
+	for {
+		if _, err := io.ReadFull(r, rec); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if int64(binary.LittleEndian.Uint64(rec[0:])) > endMs || !fn(rec) {
+			return nil
+		}
+	}
+}
+
+func msTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,153 @@
+package history
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// base is the start of a bucket of every test tier.
+var base = time.Date(2023, 10, 17, 0, 0, 0, 0, time.UTC)
+
+func openStore(t *testing.T, dir string) *Store {
+	t.Helper()
+	tiers, err := ParseTiers("5m:720h, 1h:8760h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir, 24*time.Hour, tiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestParseTiers(t *testing.T) {
+	for _, s := range []string{"5m", "500ms:1h", "5m:1m", "5m:1h, 7m:2h", "x:1h"} {
+		if _, err := ParseTiers(s); err == nil {
+			t.Errorf("ParseTiers(%q) accepted", s)
+		}
+	}
+	tiers, err := ParseTiers(" 1m:24h,, 5m:720h ")
+	if err != nil || len(tiers) != 2 || tiers[1] != (Tier{Step: 5 * time.Minute, Retention: 720 * time.Hour}) {
+		t.Errorf("ParseTiers = %v, %v", tiers, err)
+	}
+}
+
+func TestTierFor(t *testing.T) {
+	s := openStore(t, t.TempDir())
+	now := base
+	for _, tc := range []struct {
+		ago  time.Duration
+		step time.Duration
+		want time.Duration
+	}{
+		{time.Hour, 0, 0},
+		{time.Hour, 10 * time.Minute, 5 * time.Minute},
+		{time.Hour, 2 * time.Hour, time.Hour},
+		// no tier step divides 7m
+		{time.Hour, 7 * time.Minute, 0},
+		// the raw readings are gone, the finest covering tier is used
+		{48 * time.Hour, time.Minute, 5 * time.Minute},
+		{48 * time.Hour, 15 * time.Minute, 5 * time.Minute},
+		{1000 * time.Hour, 5 * time.Minute, time.Hour},
+		// nothing covers start, the longest history is used
+		{10000 * time.Hour, 5 * time.Minute, time.Hour},
+	} {
+		if got := s.tierFor(now.Add(-tc.ago), tc.step, now); got.Step != tc.want {
+			t.Errorf("tierFor(-%v, %v) = %v, want %v", tc.ago, tc.step, got.Step, tc.want)
+		}
+	}
+}
+
+func TestBucketsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir)
+	// 0, 1, 2 at 0s, 60s and 120s, then a shutdown
+	for i := 0; i < 3; i++ {
+		s.Add("bme280", "temperature", base.Add(time.Duration(i)*time.Minute), float64(i))
+	}
+	if err := s.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first bucket goes on after the restart, up to the next one
+	s = openStore(t, dir)
+	for i := 3; i < 7; i++ {
+		s.Add("bme280", "temperature", base.Add(time.Duration(i)*time.Minute), float64(i))
+	}
+	// a reading older than the last one written is ignored
+	s.Add("bme280", "temperature", base.Add(30*time.Second), 100)
+	if err := s.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(s.path("bme280", "temperature", Tier{Step: 5 * time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fi.Size() / agg_record_size; n != 2 {
+		t.Errorf("%d buckets written, want 2", n)
+	}
+	buckets, step, err := s.Buckets("bme280", "temperature", base, base.Add(time.Hour), 5*time.Minute, base.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Bucket{
+		{Time: base, Min: 0, Max: 4, Sum: 10, Count: 5},
+		{Time: base.Add(5 * time.Minute), Min: 5, Max: 6, Sum: 11, Count: 2},
+	}
+	if step != 5*time.Minute || len(buckets) != len(want) {
+		t.Fatalf("Buckets = %v, %v, want %v", buckets, step, want)
+	}
+	for i := range want {
+		if !buckets[i].Time.Equal(want[i].Time) || buckets[i].Min != want[i].Min || buckets[i].Max != want[i].Max ||
+			buckets[i].Sum != want[i].Sum || buckets[i].Count != want[i].Count {
+			t.Errorf("bucket %d = %+v, want %+v", i, buckets[i], want[i])
+		}
+	}
+
+	points, err := s.Points("bme280", "temperature", base, base.Add(time.Hour), 100)
+	if err != nil || len(points) != 7 {
+		t.Errorf("Points = %v, %v, want 7", points, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s := openStore(t, t.TempDir())
+	// a reading every hour for 3 days
+	for i := 0; i < 72; i++ {
+		s.Add("bme280", "temperature", base.Add(time.Duration(i)*time.Hour), float64(i))
+	}
+	if err := s.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	now := base.Add(72 * time.Hour)
+	if err := s.Compact(now); err != nil {
+		t.Fatal(err)
+	}
+	// the raw readings of the last 24h are kept, the buckets for longer
+	points, err := s.Points("bme280", "temperature", base, now, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 24 || points[0].Value != 48 {
+		t.Errorf("%d raw readings from %v kept, want 24 from 48", len(points), points)
+	}
+	buckets, _, err := s.Buckets("bme280", "temperature", base, now, time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 72 {
+		t.Errorf("%d hourly buckets kept, want 72", len(buckets))
+	}
+
+	// past every retention the files are removed
+	if err := s.Compact(now.Add(9000 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.Series()
+	if err != nil || len(list) != 0 {
+		t.Errorf("Series after the retention = %v, %v", list, err)
+	}
+}
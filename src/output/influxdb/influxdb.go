@@ -0,0 +1,280 @@
+package influxdb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+	"sensor-exporter/sensor"
+)
+
+const (
+	queue_size    = 10000
+	close_timeout = 10 * time.Second
+)
+
+var (
+	measurement_escaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	key_escaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+)
+
+func init() {
+	output.Register(output.Driver{
+		Name:        "influxdb",
+		Description: "write the readings to InfluxDB in line protocol",
+		ConfigKeys: []sensor.ConfigKey{
+			{Name: "url", Default: "http://localhost:8086", Help: "base URL of the InfluxDB server", Check: checkURL},
+			{Name: "api", Default: "v2", Help: "write API, v1 with database or v2 with org and bucket", Check: sensor.OneOf("v1", "v2")},
+			{Name: "database", Default: "sensors", Help: "database of the v1 API"},
+			{Name: "retention_policy", Default: "", Help: "retention policy of the v1 API, empty for the default"},
+			{Name: "username", Default: "", Help: "user name of the v1 API, empty for none"},
+			{Name: "password", Default: "", Help: "password of the v1 API"},
+			{Name: "org", Default: "", Help: "organization of the v2 API"},
+			{Name: "bucket", Default: "sensors", Help: "bucket of the v2 API"},
+			{Name: "token", Default: "", Help: "API token of the v2 API"},
+			{Name: "host", Default: "<hostname>", Help: "value of the host tag"},
+			{Name: "batch_size", Default: "1000", Help: "lines sent in one request", Kind: sensor.KindInt, Check: sensor.Positive},
+			{Name: "flush_interval", Default: "10s", Help: "interval between two writes", Kind: sensor.KindDuration, Check: sensor.Positive},
+			{Name: "timeout", Default: "10s", Help: "timeout of a write request", Kind: sensor.KindDuration, Check: sensor.Positive},
+			{Name: "buffer_file", Default: "<state_dir>/influxdb.buffer", Help: "file keeping the batches while the server is unreachable, empty to keep them in memory"},
+			{Name: "buffer_size", Default: "16777216", Help: "maximum size of the buffer in bytes, the oldest batches are dropped beyond it", Kind: sensor.KindInt, Check: sensor.Positive},
+			{Name: "ca_file", Default: "", Help: "CA certificates to verify the server, empty for the system ones"},
+			{Name: "insecure_skip_verify", Default: "false", Help: "do not verify the certificate of the server", Kind: sensor.KindBool},
+		},
+		New: func() (output.Sink, error) { return New(config.GetConfig().Influxdb) },
+	})
+}
+
+func checkURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", value)
+	}
+	return nil
+}
+
+// Sink batches readings and writes them to InfluxDB. Batches that cannot
+// be written are kept in a buffer and written again, oldest first, once
+// the server is reachable.
+type Sink struct {
+	conf     config.Influxdb
+	client   *http.Client
+	writeURL string
+	buffer   *output.Buffer
+	lines    chan []byte
+	quit     chan struct{}
+	done     chan struct{}
+
+	dropMu  sync.Mutex
+	dropped int
+
+	// owned by run
+	batch [][]byte
+	spool *output.Spool
+}
+
+// New returns a running sink configured by conf.
+func New(conf config.Influxdb) (*Sink, error) {
+	if err := checkURL(conf.Url); err != nil {
+		return nil, fmt.Errorf("influxdb: %v", err)
+	}
+	writeURL, err := buildWriteURL(conf)
+	if err != nil {
+		return nil, fmt.Errorf("influxdb: %v", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CaFile != "" {
+		pem, err := ioutil.ReadFile(conf.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("influxdb: %v", err)
+		}
+		transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+		if !transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("influxdb: %s: no certificate found", conf.CaFile)
+		}
+	}
+	buffer, err := output.OpenBuffer(conf.BufferFile, conf.BufferSize)
+	if err != nil {
+		return nil, fmt.Errorf("influxdb: %v", err)
+	}
+	if n := buffer.Len(); n > 0 {
+		log.Printf("InfluxDB output has %d buffered batches to write\n", n)
+	}
+	s := &Sink{
+		conf:     conf,
+		client:   &http.Client{Timeout: conf.Timeout, Transport: transport},
+		writeURL: writeURL,
+		buffer:   buffer,
+		lines:    make(chan []byte, queue_size),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.spool = &output.Spool{Name: "InfluxDB", Buffer: buffer, Send: s.post, BatchSize: 1}
+	go s.run()
+	return s, nil
+}
+
+func buildWriteURL(conf config.Influxdb) (string, error) {
+	q := url.Values{}
+	q.Set("precision", "ns")
+	switch conf.Api {
+	case "v1":
+		if conf.Database == "" {
+			return "", fmt.Errorf("database is required by the v1 API")
+		}
+		q.Set("db", conf.Database)
+		if conf.RetentionPolicy != "" {
+			q.Set("rp", conf.RetentionPolicy)
+		}
+		return conf.Url + "/write?" + q.Encode(), nil
+	default:
+		if conf.Bucket == "" {
+			return "", fmt.Errorf("bucket is required by the v2 API")
+		}
+		q.Set("org", conf.Org)
+		q.Set("bucket", conf.Bucket)
+		return conf.Url + "/api/v2/write?" + q.Encode(), nil
+	}
+}
+
+// Line returns the reading in line protocol. The measurement is the sensor
+// type, e.g. bme280, with a field per metrics.
+func Line(r output.Reading, host string) []byte {
+	if len(r.Values) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	b.WriteString(measurement_escaper.Replace(config.SensorType(r.Instance)))
+	// tags sorted by key, as recommended for performance
+	if host != "" {
+		b.WriteString(",host=" + key_escaper.Replace(host))
+	}
+	b.WriteString(",instance=" + key_escaper.Replace(r.Instance))
+	b.WriteString(",sensor_name=" + key_escaper.Replace(r.SensorName))
+	names := make([]string, 0, len(r.Values))
+	for name := range r.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(key_escaper.Replace(name) + "=" + strconv.FormatFloat(r.Values[name], 'f', -1, 64))
+	}
+	b.WriteString(" " + strconv.FormatInt(r.Time.UnixNano(), 10) + "\n")
+	return b.Bytes()
+}
+
+func (s *Sink) Write(r output.Reading) {
+	line := Line(r, s.conf.Host)
+	if line == nil {
+		return
+	}
+	select {
+	case s.lines <- line:
+	default:
+		s.dropMu.Lock()
+		if s.dropped == 0 {
+			log.Printf("InfluxDB queue is full, dropping readings\n")
+		}
+		s.dropped++
+		s.dropMu.Unlock()
+	}
+}
+
+// SetHealth is not written, a sensor that is down has no readings.
+func (s *Sink) SetHealth(instance, sensorName string, up bool) {}
+
+// Close writes the pending lines if the server is reachable, buffering them
+// otherwise, and stops the sink.
+func (s *Sink) Close() {
+	close(s.quit)
+	select {
+	case <-s.done:
+	case <-time.After(close_timeout):
+		log.Printf("InfluxDB output did not stop in %v\n", close_timeout)
+	}
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	defer s.buffer.Close()
+	ticker := time.NewTicker(s.conf.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			for len(s.lines) > 0 {
+				s.batch = append(s.batch, <-s.lines)
+			}
+			s.flush(true)
+			return
+		case line := <-s.lines:
+			s.batch = append(s.batch, line)
+			if len(s.batch) >= s.conf.BatchSize {
+				s.flush(false)
+			}
+		case <-ticker.C:
+			s.flush(false)
+		}
+	}
+}
+
+func (s *Sink) flush(closing bool) {
+	if len(s.batch) == 0 {
+		s.spool.Flush(nil, closing)
+		return
+	}
+	body := bytes.Join(s.batch, nil)
+	s.batch = s.batch[:0]
+	s.spool.Flush(body, closing)
+}
+
+// post writes batches of lines in one request.
+func (s *Sink) post(batches [][]byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, bytes.NewReader(bytes.Join(batches, nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch s.conf.Api {
+	case "v1":
+		if s.conf.Username != "" {
+			req.SetBasicAuth(s.conf.Username, s.conf.Password)
+		}
+	default:
+		if s.conf.Token != "" {
+			req.Header.Set("Authorization", "Token "+s.conf.Token)
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return &output.StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
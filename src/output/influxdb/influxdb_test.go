@@ -0,0 +1,83 @@
+package influxdb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+)
+
+func TestLine(t *testing.T) {
+	ts := time.Date(2023, 10, 17, 14, 1, 43, 0, time.UTC)
+	for _, tc := range []struct {
+		r    output.Reading
+		host string
+		want string
+	}{
+		{
+			output.Reading{Instance: "bme280", SensorName: "BME280", Values: map[string]float64{"temperature": 24.1, "humidity": 51}, Time: ts},
+			"pi",
+			"bme280,host=pi,instance=bme280,sensor_name=BME280 humidity=51,temperature=24.1 1697551303000000000\n",
+		},
+		{
+			// the measurement is the sensor type of the instance
+			output.Reading{Instance: "bme280.outdoor", SensorName: "BME280", Values: map[string]float64{"pressure": 1013.25}, Time: ts},
+			"",
+			"bme280,instance=bme280.outdoor,sensor_name=BME280 pressure=1013.25 1697551303000000000\n",
+		},
+		{
+			output.Reading{Instance: "mhz19c", SensorName: "MH Z19C, living=room", Values: map[string]float64{"co2 ppm": 412}, Time: ts},
+			"my pi,\n",
+			`mhz19c,host=my\ pi\,\n,instance=mhz19c,sensor_name=MH\ Z19C\,\ living\=room co2\ ppm=412 1697551303000000000` + "\n",
+		},
+		{
+			output.Reading{Instance: "bme280", SensorName: "BME280", Values: map[string]float64{"temperature": -0.000001}, Time: ts},
+			"pi",
+			"bme280,host=pi,instance=bme280,sensor_name=BME280 temperature=-0.000001 1697551303000000000\n",
+		},
+		{output.Reading{Instance: "bme280", SensorName: "BME280", Time: ts}, "pi", ""},
+	} {
+		if got := string(Line(tc.r, tc.host)); got != tc.want {
+			t.Errorf("Line(%+v, %q) = %q, want %q", tc.r, tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestBuildWriteURL(t *testing.T) {
+	for _, tc := range []struct {
+		conf config.Influxdb
+		want string
+		err  string
+	}{
+		{
+			config.Influxdb{Url: "http://localhost:8086", Api: "v1", Database: "sensors"},
+			"http://localhost:8086/write?db=sensors&precision=ns",
+			"",
+		},
+		{
+			config.Influxdb{Url: "http://localhost:8086", Api: "v1", Database: "home sensors", RetentionPolicy: "one_year"},
+			"http://localhost:8086/write?db=home+sensors&precision=ns&rp=one_year",
+			"",
+		},
+		{config.Influxdb{Url: "http://localhost:8086", Api: "v1"}, "", "database is required"},
+		{
+			config.Influxdb{Url: "https://influx.example.com", Api: "v2", Org: "home & garden", Bucket: "sensors"},
+			"https://influx.example.com/api/v2/write?bucket=sensors&org=home+%26+garden&precision=ns",
+			"",
+		},
+		{config.Influxdb{Url: "http://localhost:8086", Api: "v2", Org: "home"}, "", "bucket is required"},
+	} {
+		got, err := buildWriteURL(tc.conf)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("buildWriteURL(%+v) error = %v, want %q", tc.conf, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("buildWriteURL(%+v) = %q, %v, want %q", tc.conf, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Packet types of MQTT 3.1.1
+const (
+	packet_connect    = byte(1)
+	packet_connack    = byte(2)
+	packet_publish    = byte(3)
+	packet_puback     = byte(4)
+	packet_pingreq    = byte(12)
+	packet_pingresp   = byte(13)
+	packet_disconnect = byte(14)
+)
+
+// Broker is an in-process stand-in for an MQTT broker. It accepts
+// connections on a local port, acknowledges CONNECT, QoS 1 PUBLISH and
+// PINGREQ, records the published messages and publishes the will of a
+// client whose connection is dropped.
+type Broker struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	messages []Message
+	retained map[string]Message
+	conns    map[net.Conn]*Message // will by connection
+	connects int
+	refuse   byte
+	mute     bool
+}
+
+// NewBroker starts a broker on a free port of 127.0.0.1.
+func NewBroker() (*Broker, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		ln:       ln,
+		retained: map[string]Message{},
+		conns:    map[net.Conn]*Message{},
+	}
+	go b.accept()
+	return b, nil
+}
+
+// Addr returns the host:port the broker listens on.
+func (b *Broker) Addr() string {
+	return b.ln.Addr().String()
+}
+
+// Messages returns every message published so far, including wills.
+func (b *Broker) Messages() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Message{}, b.messages...)
+}
+
+// Retained returns the retained message of topic.
+func (b *Broker) Retained(topic string) (Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.retained[topic]
+	return m, ok
+}
+
+// Connects returns how many connections were accepted.
+func (b *Broker) Connects() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connects
+}
+
+// Refuse makes the broker refuse the next connections with CONNACK return
+// code code, 0 to accept them again.
+func (b *Broker) Refuse(code byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refuse = code
+}
+
+// Mute makes the broker stop answering PINGREQ and QoS 1 PUBLISH, as if
+// the connection silently died, while still recording the messages.
+func (b *Broker) Mute(mute bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mute = mute
+}
+
+func (b *Broker) muted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mute
+}
+
+// DropConnections closes the connections of all clients, as if the network
+// went down, which publishes their wills.
+func (b *Broker) DropConnections() {
+	b.mu.Lock()
+	conns := []net.Conn{}
+	for conn := range b.conns {
+		conns = append(conns, conn)
+	}
+	b.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (b *Broker) Close() error {
+	err := b.ln.Close()
+	b.DropConnections()
+	return err
+}
+
+func (b *Broker) accept() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	typ, body, err := readPacket(r)
+	if err != nil || typ>>4 != packet_connect {
+		return
+	}
+	will := parseWill(body)
+	b.mu.Lock()
+	refuse := b.refuse
+	if refuse == 0 {
+		b.connects++
+		b.conns[conn] = will
+	}
+	b.mu.Unlock()
+	conn.Write([]byte{packet_connack << 4, 2, 0, refuse})
+	if refuse != 0 {
+		return
+	}
+
+	clean := false
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+		if !clean && will != nil {
+			b.publish(*will)
+		}
+	}()
+	for {
+		typ, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch typ >> 4 {
+		case packet_publish:
+			m := Message{QoS: typ >> 1 & 0x03, Retain: typ&0x01 != 0}
+			topic, rest, err := readString(body)
+			if err != nil {
+				return
+			}
+			m.Topic = topic
+			if m.QoS > 0 {
+				if len(rest) < 2 {
+					return
+				}
+				if !b.muted() {
+					conn.Write([]byte{packet_puback << 4, 2, rest[0], rest[1]})
+				}
+				rest = rest[2:]
+			}
+			m.Payload = append([]byte{}, rest...)
+			b.publish(m)
+		case packet_pingreq:
+			if !b.muted() {
+				conn.Write([]byte{packet_pingresp << 4, 0})
+			}
+		case packet_disconnect:
+			clean = true
+			return
+		}
+	}
+}
+
+func (b *Broker) publish(m Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = append(b.messages, m)
+	if m.Retain {
+		b.retained[m.Topic] = m
+	}
+}
+
+// parseWill returns the will of a CONNECT packet body, if any.
+func parseWill(body []byte) *Message {
+	_, rest, err := readString(body) // protocol name
+	if err != nil || len(rest) < 4 {
+		return nil
+	}
+	flags := rest[1]
+	rest = rest[4:]
+	if _, rest, err = readString(rest); err != nil || flags&0x04 == 0 { // client id
+		return nil
+	}
+	topic, rest, err := readString(rest)
+	if err != nil {
+		return nil
+	}
+	payload, _, err := readString(rest)
+	if err != nil {
+		return nil
+	}
+	return &Message{Topic: topic, Payload: []byte(payload), QoS: flags >> 3 & 0x03, Retain: flags&0x20 != 0}
+}
+
+// readPacket reads a packet and returns its first header byte and body.
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(digit&0x7F) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// readString reads a length prefixed string from b and returns the rest.
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("short string")
+	}
+	n := int(b[0])<<8 | int(b[1])
+	if len(b) < 2+n {
+		return "", nil, errors.New("short string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
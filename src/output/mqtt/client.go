@@ -0,0 +1,139 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// milliseconds Close waits for the DISCONNECT to be sent
+const disconnect_quiesce = 250
+
+// Message is an application message, also used for the will.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Options of a connection.
+type Options struct {
+	Address   string // host:port
+	TLS       *tls.Config
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	Will      *Message
+	Timeout   time.Duration
+}
+
+// Client is a connection to the broker that publishes with QoS 0 or 1. It
+// does not reconnect by itself: Done is closed once the connection is lost,
+// e.g. when the broker does not answer a ping within the keep alive
+// interval, and the sink dials again.
+type Client struct {
+	client  paho.Client
+	timeout time.Duration
+
+	errMu    sync.Mutex
+	err      error
+	done     chan struct{}
+	closeOne sync.Once
+}
+
+// Dial connects to the broker and waits for its CONNACK.
+func Dial(opts Options) (*Client, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	c := &Client{timeout: opts.Timeout, done: make(chan struct{})}
+	o := paho.NewClientOptions().
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetProtocolVersion(4).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetKeepAlive(opts.KeepAlive).
+		SetPingTimeout(opts.KeepAlive).
+		SetConnectTimeout(opts.Timeout).
+		SetWriteTimeout(opts.Timeout).
+		SetConnectionLostHandler(func(_ paho.Client, err error) { c.fail(err) })
+	if opts.TLS != nil {
+		o.AddBroker("ssl://" + opts.Address).SetTLSConfig(opts.TLS)
+	} else {
+		o.AddBroker("tcp://" + opts.Address)
+	}
+	if opts.Will != nil {
+		o.SetBinaryWill(opts.Will.Topic, opts.Will.Payload, opts.Will.QoS, opts.Will.Retain)
+	}
+	c.client = paho.NewClient(o)
+	token := c.client.Connect()
+	if !token.WaitTimeout(opts.Timeout) {
+		c.client.Disconnect(0)
+		return nil, errors.New("no CONNACK from the broker")
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Publish sends a message. With QoS 1 it waits for the PUBACK.
+func (c *Client) Publish(m Message) error {
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	token := c.client.Publish(m.Topic, m.QoS, m.Retain, m.Payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-c.done:
+		return c.Err()
+	case <-time.After(c.timeout):
+		if m.QoS > 0 {
+			return errors.New("no PUBACK from the broker")
+		}
+		return errors.New("publish timed out")
+	}
+}
+
+// Close sends DISCONNECT, so that the broker does not publish the will, and
+// closes the connection.
+func (c *Client) Close() error {
+	select {
+	case <-c.done:
+	default:
+		c.client.Disconnect(disconnect_quiesce)
+	}
+	c.fail(errors.New("connection closed"))
+	return nil
+}
+
+// Done is closed when the connection is lost or closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection was lost.
+func (c *Client) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+func (c *Client) fail(err error) {
+	c.closeOne.Do(func() {
+		c.errMu.Lock()
+		c.err = err
+		c.errMu.Unlock()
+		close(c.done)
+	})
+}
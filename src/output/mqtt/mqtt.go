@@ -0,0 +1,404 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+	"sensor-exporter/sensor"
+)
+
+const (
+	queue_size        = 1000
+	retry_interval    = time.Second
+	retry_max_time    = time.Minute
+	close_timeout     = 5 * time.Second
+	status_online     = "online"
+	status_offline    = "offline"
+	discovery_version = "sensor-exporter"
+)
+
+// device classes of Home Assistant by unit
+var device_classes = map[string]string{
+	"°C":  "temperature",
+	"%":   "humidity",
+	"hPa": "atmospheric_pressure",
+	"ppm": "carbon_dioxide",
+	"ppb": "volatile_organic_compounds_parts",
+	"m":   "distance",
+}
+
+var unsafe_id = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+func init() {
+	output.Register(output.Driver{
+		Name:        "mqtt",
+		Description: "publish the readings to an MQTT broker, with optional Home Assistant discovery",
+		ConfigKeys: []sensor.ConfigKey{
+			{Name: "broker", Default: "tcp://localhost:1883", Help: "broker URL, ssl://, tls:// or mqtts:// for TLS", Check: checkBroker},
+			{Name: "client_id", Default: "sensor-exporter-<hostname>", Help: "client identifier, also the Home Assistant node id"},
+			{Name: "username", Default: "", Help: "user name, empty for none"},
+			{Name: "password", Default: "", Help: "password"},
+			{Name: "topic_prefix", Default: "sensor-exporter/<hostname>", Help: "readings are published to <topic_prefix>/<sensor>/<metrics>"},
+			{Name: "format", Default: "plain", Help: "payload of the readings, plain value or json with value, unit and timestamp", Check: sensor.OneOf("plain", "json")},
+			{Name: "qos", Default: "0", Help: "QoS of the published messages, 0 or 1", Kind: sensor.KindInt, Check: sensor.IntRange(0, 1)},
+			{Name: "retain", Default: "false", Help: "retain the readings on the broker", Kind: sensor.KindBool},
+			{Name: "keep_alive", Default: "60s", Help: "keep alive interval of the connection", Kind: sensor.KindDuration, Check: sensor.Positive},
+			{Name: "ca_file", Default: "", Help: "CA certificates to verify the broker, empty for the system ones"},
+			{Name: "cert_file", Default: "", Help: "client certificate, empty for none"},
+			{Name: "key_file", Default: "", Help: "key of the client certificate"},
+			{Name: "insecure_skip_verify", Default: "false", Help: "do not verify the certificate of the broker", Kind: sensor.KindBool},
+			{Name: "discovery", Default: "false", Help: "publish Home Assistant discovery configs", Kind: sensor.KindBool},
+			{Name: "discovery_prefix", Default: "homeassistant", Help: "discovery prefix of Home Assistant"},
+		},
+		New: func() (output.Sink, error) { return New(config.GetConfig().Mqtt) },
+	})
+}
+
+func checkBroker(value string) error {
+	_, _, err := parseBroker(value)
+	return err
+}
+
+// parseBroker returns the address of a broker URL and whether it uses TLS.
+func parseBroker(broker string) (string, bool, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", false, err
+	}
+	useTLS := false
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		useTLS, port = true, "8883"
+	default:
+		return "", false, fmt.Errorf("%q has an unsupported scheme, use tcp, ssl, tls or mqtts", broker)
+	}
+	if u.Hostname() == "" {
+		return "", false, fmt.Errorf("%q has no host", broker)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), useTLS, nil
+}
+
+type event struct {
+	reading    *output.Reading
+	instance   string
+	sensorName string
+	up         bool
+}
+
+type sensorState struct {
+	sensorName string
+	up         bool
+}
+
+// Sink publishes readings to a broker, reconnecting when the connection
+// is lost. Readings are queued while it is down and dropped if the queue
+// is full.
+type Sink struct {
+	conf   config.Mqtt
+	opts   Options
+	events chan event
+	quit   chan struct{}
+	done   chan struct{}
+
+	dropMu  sync.Mutex
+	dropped int
+
+	// owned by run
+	sensors    map[string]sensorState
+	discovered map[string]bool
+	// messages of the current reading not published yet, resent after a
+	// reconnect if the connection is lost
+	pending []Message
+}
+
+// New returns a running sink configured by conf.
+func New(conf config.Mqtt) (*Sink, error) {
+	addr, useTLS, err := parseBroker(conf.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: %v", err)
+	}
+	opts := Options{
+		Address:   addr,
+		ClientID:  conf.ClientId,
+		Username:  conf.Username,
+		Password:  conf.Password,
+		KeepAlive: conf.KeepAlive,
+		Will:      &Message{Topic: conf.TopicPrefix + "/status", Payload: []byte(status_offline), QoS: byte(conf.Qos), Retain: true},
+	}
+	if useTLS {
+		if opts.TLS, err = tlsConfig(conf, addr); err != nil {
+			return nil, fmt.Errorf("mqtt: %v", err)
+		}
+	}
+	s := &Sink{
+		conf:       conf,
+		opts:       opts,
+		events:     make(chan event, queue_size),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		sensors:    map[string]sensorState{},
+		discovered: map[string]bool{},
+	}
+	go s.run()
+	return s, nil
+}
+
+func tlsConfig(conf config.Mqtt, addr string) (*tls.Config, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	c := &tls.Config{ServerName: host, InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CaFile != "" {
+		pem, err := ioutil.ReadFile(conf.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found", conf.CaFile)
+		}
+	}
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+func (s *Sink) Write(r output.Reading) {
+	s.queue(event{reading: &r})
+}
+
+func (s *Sink) SetHealth(instance, sensorName string, up bool) {
+	s.queue(event{instance: instance, sensorName: sensorName, up: up})
+}
+
+func (s *Sink) queue(e event) {
+	select {
+	case s.events <- e:
+	default:
+		s.dropMu.Lock()
+		if s.dropped == 0 {
+			log.Printf("MQTT queue is full, dropping readings\n")
+		}
+		s.dropped++
+		s.dropMu.Unlock()
+	}
+}
+
+// Close publishes the offline status and disconnects.
+func (s *Sink) Close() {
+	close(s.quit)
+	select {
+	case <-s.done:
+	case <-time.After(close_timeout):
+		log.Printf("MQTT output did not stop in %v\n", close_timeout)
+	}
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	wait := retry_interval
+	failing := false
+	for {
+		client, err := Dial(s.opts)
+		if err != nil {
+			if !failing {
+				log.Printf("Failed to connect to MQTT broker %s: %v\n", s.conf.Broker, err)
+				failing = true
+			}
+			select {
+			case <-s.quit:
+				return
+			case <-time.After(wait):
+			}
+			if wait *= 2; wait > retry_max_time {
+				wait = retry_max_time
+			}
+			continue
+		}
+		log.Printf("Connected to MQTT broker %s\n", s.conf.Broker)
+		failing = false
+		wait = retry_interval
+
+		if s.serve(client) {
+			return
+		}
+		log.Printf("Lost connection to MQTT broker %s: %v\n", s.conf.Broker, client.Err())
+	}
+}
+
+// serve publishes events until the connection fails or the sink is
+// closed, and reports whether it was closed.
+func (s *Sink) serve(client *Client) bool {
+	defer client.Close()
+	// discovery configs are retained, but the broker may have lost them
+	s.discovered = map[string]bool{}
+	err := s.publish(client, s.conf.TopicPrefix+"/status", status_online, true)
+	for _, instance := range sortedInstances(s.sensors) {
+		if err == nil {
+			err = s.publishHealth(client, instance, s.sensors[instance].up)
+		}
+	}
+	if err == nil {
+		err = s.flush(client)
+	}
+	for err == nil {
+		select {
+		case <-s.quit:
+			// drain what is queued before going offline
+			for len(s.events) > 0 && err == nil {
+				err = s.handle(client, <-s.events)
+			}
+			s.publish(client, s.conf.TopicPrefix+"/status", status_offline, true)
+			return true
+		case <-client.Done():
+			return false
+		case e := <-s.events:
+			err = s.handle(client, e)
+		}
+	}
+	return false
+}
+
+func (s *Sink) handle(client *Client, e event) error {
+	if e.reading == nil {
+		s.sensors[e.instance] = sensorState{sensorName: e.sensorName, up: e.up}
+		return s.publishHealth(client, e.instance, e.up)
+	}
+	r := e.reading
+	if _, ok := s.sensors[r.Instance]; !ok {
+		s.sensors[r.Instance] = sensorState{sensorName: r.SensorName, up: true}
+		if err := s.publishHealth(client, r.Instance, true); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(r.Values))
+	for name := range r.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		unit := output.Unit(r.Help[name])
+		if s.conf.Discovery {
+			s.addDiscovery(r, name, unit)
+		}
+		var payload string
+		switch s.conf.Format {
+		case "json":
+			b, _ := json.Marshal(struct {
+				Value     float64 `json:"value"`
+				Unit      string  `json:"unit,omitempty"`
+				Timestamp string  `json:"timestamp"`
+			}{r.Values[name], unit, r.Time.UTC().Format(time.RFC3339Nano)})
+			payload = string(b)
+		default:
+			payload = strconv.FormatFloat(r.Values[name], 'f', -1, 64)
+		}
+		s.add(s.stateTopic(r.Instance, name), payload, s.conf.Retain)
+	}
+	return s.flush(client)
+}
+
+func (s *Sink) publishHealth(client *Client, instance string, up bool) error {
+	status := status_offline
+	if up {
+		status = status_online
+	}
+	return s.publish(client, s.conf.TopicPrefix+"/"+instance+"/availability", status, true)
+}
+
+// addDiscovery queues the Home Assistant config of a metrics once per
+// connection.
+func (s *Sink) addDiscovery(r *output.Reading, name, unit string) {
+	node := unsafe_id.ReplaceAllString(s.conf.ClientId, "_")
+	object := unsafe_id.ReplaceAllString(r.Instance+"_"+name, "_")
+	topic := s.conf.DiscoveryPrefix + "/sensor/" + node + "/" + object + "/config"
+	if s.discovered[topic] {
+		return
+	}
+	payload := map[string]interface{}{
+		"name":        name,
+		"unique_id":   node + "_" + object,
+		"state_topic": s.stateTopic(r.Instance, name),
+		"state_class": "measurement",
+		"availability": []map[string]string{
+			{"topic": s.conf.TopicPrefix + "/status"},
+			{"topic": s.conf.TopicPrefix + "/" + r.Instance + "/availability"},
+		},
+		"availability_mode": "all",
+		"device": map[string]interface{}{
+			"identifiers": []string{node + "_" + unsafe_id.ReplaceAllString(r.Instance, "_")},
+			"name":        r.Instance,
+			"model":       r.SensorName,
+			"sw_version":  discovery_version,
+		},
+	}
+	if unit != "" {
+		payload["unit_of_measurement"] = unit
+		if class, ok := device_classes[unit]; ok {
+			payload["device_class"] = class
+		}
+	}
+	if s.conf.Format == "json" {
+		payload["value_template"] = "{{ value_json.value }}"
+	}
+	b, _ := json.Marshal(payload)
+	s.add(topic, string(b), true)
+	s.discovered[topic] = true
+}
+
+func (s *Sink) stateTopic(instance, name string) string {
+	return s.conf.TopicPrefix + "/" + instance + "/" + name
+}
+
+func (s *Sink) publish(client *Client, topic, payload string, retain bool) error {
+	return client.Publish(Message{Topic: topic, Payload: []byte(payload), QoS: byte(s.conf.Qos), Retain: retain})
+}
+
+func (s *Sink) add(topic, payload string, retain bool) {
+	s.pending = append(s.pending, Message{Topic: topic, Payload: []byte(payload), QoS: byte(s.conf.Qos), Retain: retain})
+}
+
+// flush publishes the pending messages in order. A QoS 1 message that was
+// not acknowledged stays pending; a QoS 0 one is dropped.
+func (s *Sink) flush(client *Client) error {
+	for len(s.pending) > 0 {
+		if err := client.Publish(s.pending[0]); err != nil {
+			if s.pending[0].QoS == 0 {
+				s.pending = s.pending[1:]
+			}
+			return err
+		}
+		s.pending = s.pending[1:]
+	}
+	return nil
+}
+
+func sortedInstances(m map[string]sensorState) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
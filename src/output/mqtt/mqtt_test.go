@@ -0,0 +1,304 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+)
+
+func newBroker(t *testing.T) *Broker {
+	t.Helper()
+	b, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// waitFor polls cond until it holds or a few seconds passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func published(b *Broker, topic string) []Message {
+	var list []Message
+	for _, m := range b.Messages() {
+		if m.Topic == topic {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+func testConf(b *Broker) config.Mqtt {
+	return config.Mqtt{
+		Broker:          "tcp://" + b.Addr(),
+		ClientId:        "pi.livingroom",
+		TopicPrefix:     "sensor-exporter/pi",
+		Format:          "plain",
+		Qos:             1,
+		KeepAlive:       time.Minute,
+		DiscoveryPrefix: "homeassistant",
+	}
+}
+
+func reading(temp float64) output.Reading {
+	return output.Reading{
+		Instance:   "bme280",
+		SensorName: "BME280",
+		Values:     map[string]float64{"temperature": temp},
+		Help:       map[string]string{"temperature": "Temperature [°C]"},
+		Time:       time.Date(2023, 10, 17, 14, 1, 43, 0, time.UTC),
+	}
+}
+
+func TestParseBroker(t *testing.T) {
+	for _, tc := range []struct {
+		broker string
+		addr   string
+		tls    bool
+		err    string
+	}{
+		{"tcp://localhost", "localhost:1883", false, ""},
+		{"mqtt://10.0.0.1:1884", "10.0.0.1:1884", false, ""},
+		{"mqtts://broker.example.com", "broker.example.com:8883", true, ""},
+		{"ssl://broker.example.com:8884", "broker.example.com:8884", true, ""},
+		{"http://localhost", "", false, "unsupported scheme"},
+		{"tcp://", "", false, "no host"},
+	} {
+		addr, useTLS, err := parseBroker(tc.broker)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("parseBroker(%q) error = %v, want %q", tc.broker, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || addr != tc.addr || useTLS != tc.tls {
+			t.Errorf("parseBroker(%q) = %q, %v, %v, want %q, %v", tc.broker, addr, useTLS, err, tc.addr, tc.tls)
+		}
+	}
+}
+
+func TestConnectWill(t *testing.T) {
+	b := newBroker(t)
+	will := &Message{Topic: "sensor-exporter/pi/status", Payload: []byte("offline"), QoS: 1, Retain: true}
+	c, err := Dial(Options{Address: b.Addr(), ClientID: "test", Username: "user", Password: "secret", Will: will})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := b.Connects(); n != 1 {
+		t.Errorf("%d connects, want 1", n)
+	}
+
+	// the will is published when the connection drops, not on DISCONNECT
+	b.DropConnections()
+	<-c.Done()
+	waitFor(t, "the will", func() bool { _, ok := b.Retained(will.Topic); return ok })
+	m, _ := b.Retained(will.Topic)
+	if string(m.Payload) != "offline" || m.QoS != 1 || !m.Retain {
+		t.Errorf("will = %+v", m)
+	}
+
+	c, err = Dial(Options{Address: b.Addr(), ClientID: "test", Will: &Message{Topic: "will/clean", Payload: []byte("gone")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	time.Sleep(50 * time.Millisecond)
+	if list := published(b, "will/clean"); len(list) != 0 {
+		t.Errorf("will published after DISCONNECT: %v", list)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	b := newBroker(t)
+	b.Refuse(5)
+	if _, err := Dial(Options{Address: b.Addr(), ClientID: "test"}); err == nil || !strings.Contains(strings.ToLower(err.Error()), "not authorized") {
+		t.Errorf("Dial = %v, want not authorized", err)
+	}
+}
+
+func TestPublishQoS1(t *testing.T) {
+	b := newBroker(t)
+	c, err := Dial(Options{Address: b.Addr(), ClientID: "test", Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Publish returns once the broker acknowledged the message
+	for i := 0; i < 3; i++ {
+		if err := c.Publish(Message{Topic: "t", Payload: []byte{byte('0' + i)}, QoS: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(b.Messages()); n != i+1 {
+			t.Fatalf("%d messages after PUBACK %d", n, i+1)
+		}
+	}
+
+	b.Mute(true)
+	if err := c.Publish(Message{Topic: "t", Payload: []byte("x"), QoS: 1}); err == nil || !strings.Contains(err.Error(), "PUBACK") {
+		t.Errorf("Publish without PUBACK = %v", err)
+	}
+	// QoS 0 does not wait
+	if err := c.Publish(Message{Topic: "t", Payload: []byte("y")}); err != nil {
+		t.Errorf("Publish QoS 0 = %v", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	b := newBroker(t)
+	// keep alive is in whole seconds, and checked every half
+	c, err := Dial(Options{Address: b.Addr(), ClientID: "test", KeepAlive: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// answered pings keep the connection
+	select {
+	case <-c.Done():
+		t.Fatalf("connection lost: %v", c.Err())
+	case <-time.After(3500 * time.Millisecond):
+	}
+
+	b.Mute(true)
+	select {
+	case <-c.Done():
+		if err := c.Err(); err == nil || !strings.Contains(err.Error(), "pingresp") {
+			t.Errorf("Err = %v, want no PINGRESP", err)
+		}
+	case <-time.After(6 * time.Second):
+		t.Errorf("connection kept without PINGRESP")
+	}
+}
+
+func TestSinkAvailability(t *testing.T) {
+	b := newBroker(t)
+	s, err := New(testConf(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetHealth("bme280", "BME280", true)
+	s.Write(reading(24.1))
+	waitFor(t, "the reading", func() bool { return len(published(b, "sensor-exporter/pi/bme280/temperature")) == 1 })
+	s.SetHealth("bme280", "BME280", false)
+	waitFor(t, "the health", func() bool {
+		m, _ := b.Retained("sensor-exporter/pi/bme280/availability")
+		return string(m.Payload) == "offline"
+	})
+
+	if m, _ := b.Retained("sensor-exporter/pi/status"); string(m.Payload) != "online" {
+		t.Errorf("status = %q, want online", m.Payload)
+	}
+	m := published(b, "sensor-exporter/pi/bme280/temperature")[0]
+	if string(m.Payload) != "24.1" || m.QoS != 1 || m.Retain {
+		t.Errorf("reading = %+v", m)
+	}
+
+	// the availability is published again on a new connection
+	b.DropConnections()
+	waitFor(t, "the reconnect", func() bool { return b.Connects() == 2 })
+	waitFor(t, "the availability", func() bool { return len(published(b, "sensor-exporter/pi/bme280/availability")) == 3 })
+
+	s.Close()
+	if m, _ := b.Retained("sensor-exporter/pi/status"); string(m.Payload) != "offline" {
+		t.Errorf("status after Close = %q, want offline", m.Payload)
+	}
+}
+
+func TestSinkDiscovery(t *testing.T) {
+	b := newBroker(t)
+	conf := testConf(b)
+	conf.Discovery = true
+	conf.Format = "json"
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Write(reading(24.1))
+	s.Write(reading(24.2))
+	state := "sensor-exporter/pi/bme280/temperature"
+	waitFor(t, "the readings", func() bool { return len(published(b, state)) == 2 })
+
+	topic := "homeassistant/sensor/pi_livingroom/bme280_temperature/config"
+	list := published(b, topic)
+	if len(list) != 1 || !list[0].Retain {
+		t.Fatalf("discovery configs = %+v, want one retained", list)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(list[0].Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{
+		"name":                "temperature",
+		"unique_id":           "pi_livingroom_bme280_temperature",
+		"state_topic":         state,
+		"state_class":         "measurement",
+		"unit_of_measurement": "°C",
+		"device_class":        "temperature",
+		"value_template":      "{{ value_json.value }}",
+		"availability_mode":   "all",
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %v", key, got[key], want)
+		}
+	}
+	device, _ := got["device"].(map[string]interface{})
+	if device["name"] != "bme280" || device["model"] != "BME280" {
+		t.Errorf("device = %v", device)
+	}
+
+	var value struct {
+		Value     float64
+		Unit      string
+		Timestamp string
+	}
+	if err := json.Unmarshal(published(b, state)[0].Payload, &value); err != nil {
+		t.Fatal(err)
+	}
+	if value.Value != 24.1 || value.Unit != "°C" || value.Timestamp != "2023-10-17T14:01:43Z" {
+		t.Errorf("payload = %+v", value)
+	}
+}
+
+func TestSinkResendsUnacked(t *testing.T) {
+	b := newBroker(t)
+	s, err := New(testConf(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	state := "sensor-exporter/pi/bme280/temperature"
+	s.Write(reading(24.1))
+	waitFor(t, "the reading", func() bool { return len(published(b, state)) == 1 })
+
+	// the broker receives the reading but the PUBACK is lost
+	b.Mute(true)
+	s.Write(reading(24.2))
+	waitFor(t, "the unacked reading", func() bool { return len(published(b, state)) == 2 })
+	b.Mute(false)
+	b.DropConnections()
+
+	waitFor(t, "the resend", func() bool { return len(published(b, state)) == 3 })
+	if m := published(b, state)[2]; string(m.Payload) != "24.2" || m.QoS != 1 {
+		t.Errorf("resent %+v, want 24.2", m)
+	}
+
+	s.Write(reading(24.3))
+	waitFor(t, "the next reading", func() bool { return len(published(b, state)) == 4 })
+	if m := published(b, state)[3]; string(m.Payload) != "24.3" {
+		t.Errorf("next reading = %+v", m)
+	}
+}
@@ -0,0 +1,155 @@
+package output
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"sensor-exporter/sensor"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reading is a reading of a sensor after its pipeline, as exported.
+type Reading struct {
+	Instance   string
+	SensorName string
+	Values     map[string]float64
+	// Help holds the metrics descriptions, see Unit.
+	Help map[string]string
+	Time time.Time
+}
+
+// Sink sends readings to another system. Write and SetHealth are called by
+// the pollers and must not block, so sinks queue and send in the background.
+type Sink interface {
+	Write(r Reading)
+	// SetHealth reports whether a sensor is up.
+	SetHealth(instance, sensorName string, up bool)
+	// Close sends what is queued if possible and stops the sink.
+	Close()
+}
+
+// Driver describes an output that can be named in enable_output. It is
+// configured by the section of the same name.
+type Driver struct {
+	Name        string
+	Description string
+	ConfigKeys  []sensor.ConfigKey
+	New         func() (Sink, error)
+}
+
+var (
+	driversMu sync.Mutex
+	drivers   = map[string]Driver{}
+
+	sinksMu sync.RWMutex
+	sinks   = map[string]Sink{}
+
+	unitPattern = regexp.MustCompile(`\[([^\]]+)\]`)
+)
+
+// Gatherer gathers the metrics served on /metrics, for outputs sending them
+// as they are. The exporter sets it before starting the outputs.
+var Gatherer prometheus.Gatherer
+
+// Register makes an output available by name. It panics if the name is
+// already registered.
+func Register(d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if d.New == nil {
+		panic("output: Register output " + d.Name + " without constructor")
+	}
+	if _, dup := drivers[d.Name]; dup {
+		panic("output: Register called twice for output " + d.Name)
+	}
+	drivers[d.Name] = d
+}
+
+// Drivers returns the registered outputs sorted by name.
+func Drivers() []Driver {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	list := make([]Driver, 0, len(drivers))
+	for _, d := range drivers {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func LookupDriver(name string) (Driver, error) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	d, ok := drivers[name]
+	if !ok {
+		return Driver{}, fmt.Errorf("unknown output %q", name)
+	}
+	return d, nil
+}
+
+// Start adds a running sink under name, closing the one it replaces. A sink
+// owns its files, e.g. a Buffer, so one replaced by a sink using the same
+// files must be stopped with Stop before the new one is created.
+func Start(name string, s Sink) {
+	sinksMu.Lock()
+	old := sinks[name]
+	sinks[name] = s
+	sinksMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// Stop closes the sink name.
+func Stop(name string) {
+	sinksMu.Lock()
+	s := sinks[name]
+	delete(sinks, name)
+	sinksMu.Unlock()
+	if s != nil {
+		s.Close()
+	}
+}
+
+// Running returns the names of the running sinks.
+func Running() []string {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	names := []string{}
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Write hands a reading to every running sink.
+func Write(r Reading) {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	for _, s := range sinks {
+		s.Write(r)
+	}
+}
+
+// SetHealth hands the health of a sensor to every running sink.
+func SetHealth(instance, sensorName string, up bool) {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	for _, s := range sinks {
+		s.SetHealth(instance, sensorName, up)
+	}
+}
+
+// Unit returns the unit of a metrics from its description, e.g. "ppm" for
+// "CO2 value in [ppm] measured by MH-Z19C", or "" if there is none.
+func Unit(help string) string {
+	if m := unitPattern.FindStringSubmatch(help); m != nil {
+		return m[1]
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf encoding of the remote write messages:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+//
+// Serialized messages concatenate into one with their repeated fields
+// joined, so WriteRequests of several gathers are sent by joining them.
+
+type label struct {
+	name  string
+	value string
+}
+
+// encodeFamilies returns a WriteRequest with a series per metric of the
+// families, sampled at ts in milliseconds unless the metric has its own
+// timestamp. Histograms and summaries are split into their series as in the
+// text format.
+func encodeFamilies(families []*dto.MetricFamily, external map[string]string, ts int64) []byte {
+	var b []byte
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			labels := make([]label, 0, len(m.Label)+len(external)+2)
+			for _, l := range m.Label {
+				labels = append(labels, label{l.GetName(), l.GetValue()})
+			}
+			t := ts
+			if m.TimestampMs != nil {
+				t = m.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, extra ...label) {
+				b = appendSeries(b, seriesLabels(name+suffix, labels, extra, external), value, t)
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.Counter.GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.Gauge.GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.Untyped.GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.Summary.Quantile {
+					add("", q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", m.Summary.GetSampleSum())
+				add("_count", float64(m.Summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				infSeen := false
+				for _, bucket := range m.Histogram.Bucket {
+					if math.IsInf(bucket.GetUpperBound(), 1) {
+						infSeen = true
+					}
+					add("_bucket", float64(bucket.GetCumulativeCount()), label{"le", formatFloat(bucket.GetUpperBound())})
+				}
+				if !infSeen {
+					add("_bucket", float64(m.Histogram.GetSampleCount()), label{"le", "+Inf"})
+				}
+				add("_sum", m.Histogram.GetSampleSum())
+				add("_count", float64(m.Histogram.GetSampleCount()))
+			}
+		}
+	}
+	return b
+}
+
+// seriesLabels returns the labels of a series sorted by name, as remote
+// write requires. Labels of the metric win over external labels.
+func seriesLabels(name string, labels, extra []label, external map[string]string) []label {
+	list := make([]label, 0, len(labels)+len(extra)+len(external)+1)
+	list = append(list, label{"__name__", name})
+	list = append(list, labels...)
+	list = append(list, extra...)
+	for n, v := range external {
+		found := false
+		for _, l := range list {
+			if l.name == n {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, label{n, v})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// appendSeries appends a TimeSeries with one sample as field 1 of a
+// WriteRequest.
+func appendSeries(b []byte, labels []label, value float64, ts int64) []byte {
+	var series []byte
+	for _, l := range labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.name)
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.value)
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, lb)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, series)
+}
@@ -0,0 +1,251 @@
+package remotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"sensor-exporter/config"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// writeRequest is the descriptor of the WriteRequest of remote write, as in
+// prompb, to decode what the sink sends with the protobuf library.
+var writeRequest = func() protoreflect.MessageDescriptor {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, message string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+		if message != "" {
+			f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			f.TypeName = proto.String(".prometheus." + message)
+		}
+		return f
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	msg := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("remote.proto"),
+		Package: proto.String("prometheus"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("WriteRequest", field("timeseries", 1, msg, "TimeSeries")),
+			message("TimeSeries", field("labels", 1, msg, "Label"), field("samples", 2, msg, "Sample")),
+			message("Label",
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")),
+			message("Sample",
+				field("value", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, ""),
+				field("timestamp", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, "")),
+		},
+	}
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		panic(err)
+	}
+	return fd.Messages().ByName("WriteRequest")
+}()
+
+type sample struct {
+	labels string // name{label="value",...}
+	value  float64
+	ts     int64
+}
+
+// decode unmarshals a WriteRequest with the protobuf library.
+func decode(t *testing.T, b []byte) []sample {
+	t.Helper()
+	req := dynamicpb.NewMessage(writeRequest)
+	if err := proto.Unmarshal(b, req); err != nil {
+		t.Fatalf("unmarshal WriteRequest: %v", err)
+	}
+	var list []sample
+	series := req.Get(writeRequest.Fields().ByName("timeseries")).List()
+	for i := 0; i < series.Len(); i++ {
+		ts := series.Get(i).Message()
+		fields := ts.Descriptor().Fields()
+		labels := ts.Get(fields.ByName("labels")).List()
+		var name string
+		var pairs []string
+		for j := 0; j < labels.Len(); j++ {
+			l := labels.Get(j).Message()
+			lf := l.Descriptor().Fields()
+			n, v := l.Get(lf.ByName("name")).String(), l.Get(lf.ByName("value")).String()
+			if n == "__name__" {
+				name = v
+			} else {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", n, v))
+			}
+			if j > 0 && labels.Get(j-1).Message().Get(lf.ByName("name")).String() >= n {
+				t.Errorf("labels of %s not sorted at %s", name, n)
+			}
+		}
+		samples := ts.Get(fields.ByName("samples")).List()
+		if samples.Len() != 1 {
+			t.Fatalf("series %s has %d samples", name, samples.Len())
+		}
+		s := samples.Get(0).Message()
+		sf := s.Descriptor().Fields()
+		list = append(list, sample{
+			labels: name + "{" + strings.Join(pairs, ",") + "}",
+			value:  s.Get(sf.ByName("value")).Float(),
+			ts:     s.Get(sf.ByName("timestamp")).Int(),
+		})
+	}
+	return list
+}
+
+func TestEncodeFamilies(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("temperature"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{{Name: proto.String("sensor_instance"), Value: proto.String("bme280")}},
+				Gauge: &dto.Gauge{Value: proto.Float64(-3.25)},
+			}, {
+				// its own timestamp, and a label overriding an external one
+				Label:       []*dto.LabelPair{{Name: proto.String("instance"), Value: proto.String("outdoor")}},
+				Gauge:       &dto.Gauge{Value: proto.Float64(math.Inf(1))},
+				TimestampMs: proto.Int64(1000),
+			}},
+		},
+		{
+			Name:   proto.String("mhz19c_rejected_frames_total"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(3)}}},
+		},
+		{
+			Name: proto.String("poll_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(4),
+				SampleSum:   proto.Float64(0.5),
+				Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(3)}},
+			}}},
+		},
+		{
+			Name: proto.String("read_seconds"),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{{Summary: &dto.Summary{
+				SampleCount: proto.Uint64(2),
+				SampleSum:   proto.Float64(0.25),
+				Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(0.1)}},
+			}}},
+		},
+	}
+	external := map[string]string{"job": "sensor-exporter", "instance": "pi"}
+	got := decode(t, encodeFamilies(families, external, 1697551303822))
+	const ts = 1697551303822
+	want := []sample{
+		{`temperature{instance="pi",job="sensor-exporter",sensor_instance="bme280"}`, -3.25, ts},
+		{`temperature{instance="outdoor",job="sensor-exporter"}`, math.Inf(1), 1000},
+		{`mhz19c_rejected_frames_total{instance="pi",job="sensor-exporter"}`, 3, ts},
+		{`poll_seconds_bucket{instance="pi",job="sensor-exporter",le="0.1"}`, 3, ts},
+		{`poll_seconds_bucket{instance="pi",job="sensor-exporter",le="+Inf"}`, 4, ts},
+		{`poll_seconds_sum{instance="pi",job="sensor-exporter"}`, 0.5, ts},
+		{`poll_seconds_count{instance="pi",job="sensor-exporter"}`, 4, ts},
+		{`read_seconds{instance="pi",job="sensor-exporter",quantile="0.5"}`, 0.1, ts},
+		{`read_seconds_sum{instance="pi",job="sensor-exporter"}`, 0.25, ts},
+		{`read_seconds_count{instance="pi",job="sensor-exporter"}`, 2, ts},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d series, want %d:\n%v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("series %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// largeFamilies returns n gauges with long label sets, whose encoding needs
+// multi-byte lengths at every level.
+func largeFamilies(n int) []*dto.MetricFamily {
+	mf := &dto.MetricFamily{Name: proto.String("reading"), Type: dto.MetricType_GAUGE.Enum()}
+	for i := 0; i < n; i++ {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(float64(i) / 7)}}
+		for j := 0; j < 30; j++ {
+			m.Label = append(m.Label, &dto.LabelPair{
+				Name:  proto.String(fmt.Sprintf("label_%02d", j)),
+				Value: proto.String(fmt.Sprintf("%d-%s", i, strings.Repeat("v", 200+j*10))),
+			})
+		}
+		mf.Metric = append(mf.Metric, m)
+	}
+	return []*dto.MetricFamily{mf}
+}
+
+func TestEncodeLargeRequest(t *testing.T) {
+	req := encodeFamilies(largeFamilies(2000), nil, 1)
+	if len(req) < 1<<24 {
+		t.Fatalf("request of %d bytes, want at least 16 MiB", len(req))
+	}
+	got := decode(t, req)
+	if len(got) != 2000 {
+		t.Fatalf("decoded %d series, want 2000", len(got))
+	}
+	for _, i := range []int{0, 1, 999, 1999} {
+		if got[i].value != float64(i)/7 || !strings.Contains(got[i].labels, fmt.Sprintf(`label_29="%d-%s"`, i, strings.Repeat("v", 490))) {
+			t.Errorf("series %d = %.80s... %v", i, got[i].labels, got[i].value)
+		}
+	}
+}
+
+func TestPost(t *testing.T) {
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "bad headers", http.StatusBadRequest)
+			return
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+	s := &Sink{conf: config.RemoteWrite{Url: srv.URL, BearerToken: "secret"}, client: srv.Client()}
+
+	// samples of several intervals are joined into one WriteRequest
+	first := encodeFamilies(largeFamilies(300), map[string]string{"job": "a"}, 1)
+	second := encodeFamilies(largeFamilies(300), map[string]string{"job": "b"}, 2)
+	if err := s.post([][]byte{first, second}); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("%d requests, want 1", len(bodies))
+	}
+	got := decode(t, bodies[0])
+	if len(got) != 600 || got[0].ts != 1 || got[599].ts != 2 {
+		t.Fatalf("decoded %d series", len(got))
+	}
+	for i, s := range got {
+		job := `job="a"`
+		if i >= 300 {
+			job = `job="b"`
+		}
+		if !strings.Contains(s.labels, job) {
+			t.Fatalf("series %d = %.80s..., want %s", i, s.labels, job)
+		}
+	}
+}
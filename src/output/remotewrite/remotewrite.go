@@ -0,0 +1,200 @@
+package remotewrite
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+	"sensor-exporter/sensor"
+
+	"github.com/golang/snappy"
+)
+
+const close_timeout = 10 * time.Second
+
+var label_name = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func init() {
+	output.Register(output.Driver{
+		Name:        "remote_write",
+		Description: "send the metrics served on /metrics with the Prometheus remote write protocol",
+		ConfigKeys: []sensor.ConfigKey{
+			{Name: "url", Default: "", Help: "remote write endpoint, e.g. http://prometheus:9090/api/v1/write", Check: checkURL},
+			{Name: "interval", Default: "15s", Help: "interval between two samples of the metrics", Kind: sensor.KindDuration, Check: sensor.Positive},
+			{Name: "timeout", Default: "30s", Help: "timeout of a request", Kind: sensor.KindDuration, Check: sensor.Positive},
+			{Name: "username", Default: "", Help: "user name of basic authentication, empty for none"},
+			{Name: "password", Default: "", Help: "password of basic authentication"},
+			{Name: "bearer_token", Default: "", Help: "bearer token, empty for none"},
+			{Name: "external_labels", Default: "job=sensor-exporter,instance=<hostname>", Help: "comma separated name=value labels added to every series", Check: checkLabels},
+			{Name: "batch_size", Default: "20", Help: "samples of the metrics sent in one request when backfilling", Kind: sensor.KindInt, Check: sensor.Positive},
+			{Name: "wal_file", Default: "<state_dir>/remote_write.wal", Help: "file keeping the samples while the endpoint is unreachable, empty to keep them in memory"},
+			{Name: "wal_size", Default: "16777216", Help: "maximum size of the wal in bytes, the oldest samples are dropped beyond it", Kind: sensor.KindInt, Check: sensor.Positive},
+			{Name: "ca_file", Default: "", Help: "CA certificates to verify the endpoint, empty for the system ones"},
+			{Name: "insecure_skip_verify", Default: "false", Help: "do not verify the certificate of the endpoint", Kind: sensor.KindBool},
+		},
+		New: func() (output.Sink, error) { return New(config.GetConfig().RemoteWrite) },
+	})
+}
+
+func checkURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", value)
+	}
+	return nil
+}
+
+func checkLabels(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !label_name.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("%q is not a valid name=value label", strings.TrimSpace(pair))
+		}
+	}
+	return nil
+}
+
+// Sink samples the metrics of output.Gatherer every interval and sends them
+// to a remote write endpoint. Samples that cannot be sent are kept in the
+// wal and sent in order before new ones, so that the gap is backfilled once
+// the endpoint is reachable; sending new samples first would make the
+// older ones out of order.
+type Sink struct {
+	conf   config.RemoteWrite
+	client *http.Client
+	wal    *output.Buffer
+	spool  *output.Spool
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// New returns a running sink configured by conf.
+func New(conf config.RemoteWrite) (*Sink, error) {
+	if err := checkURL(conf.Url); err != nil {
+		return nil, fmt.Errorf("remote_write: %v", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CaFile != "" {
+		pem, err := ioutil.ReadFile(conf.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("remote_write: %v", err)
+		}
+		transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+		if !transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("remote_write: %s: no certificate found", conf.CaFile)
+		}
+	}
+	wal, err := output.OpenBuffer(conf.WalFile, conf.WalSize)
+	if err != nil {
+		return nil, fmt.Errorf("remote_write: %v", err)
+	}
+	if n := wal.Len(); n > 0 {
+		log.Printf("Remote write has %d samples of the metrics to backfill\n", n)
+	}
+	s := &Sink{
+		conf:   conf,
+		client: &http.Client{Timeout: conf.Timeout, Transport: transport},
+		wal:    wal,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.spool = &output.Spool{Name: "Remote write", Buffer: wal, Send: s.post, BatchSize: conf.BatchSize}
+	go s.run()
+	return s, nil
+}
+
+// Write is not used, the metrics are gathered as served on /metrics.
+func (s *Sink) Write(r output.Reading) {}
+
+func (s *Sink) SetHealth(instance, sensorName string, up bool) {}
+
+// Close sends the samples in the wal if the endpoint is reachable, and
+// stops the sink.
+func (s *Sink) Close() {
+	close(s.quit)
+	select {
+	case <-s.done:
+	case <-time.After(close_timeout):
+		log.Printf("Remote write did not stop in %v\n", close_timeout)
+	}
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	defer s.wal.Close()
+	ticker := time.NewTicker(s.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			if s.wal.Len() > 0 {
+				s.spool.Flush(nil, true)
+			}
+			return
+		case now := <-ticker.C:
+			s.spool.Flush(s.sample(now), false)
+		}
+	}
+}
+
+// sample returns the metrics as a WriteRequest, or nil if there are none.
+func (s *Sink) sample(now time.Time) []byte {
+	if output.Gatherer == nil {
+		return nil
+	}
+	families, err := output.Gatherer.Gather()
+	if err != nil {
+		// like promhttp, send what could be gathered
+		log.Printf("Remote write gather error: %v\n", err)
+	}
+	req := encodeFamilies(families, s.conf.ExternalLabels, now.UnixNano()/int64(time.Millisecond))
+	if len(req) == 0 {
+		return nil
+	}
+	return req
+}
+
+// post sends samples joined into one WriteRequest.
+func (s *Sink) post(samples [][]byte) error {
+	body := snappy.Encode(nil, bytes.Join(samples, nil))
+	req, err := http.NewRequest(http.MethodPost, s.conf.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "sensor-exporter")
+	if s.conf.Username != "" {
+		req.SetBasicAuth(s.conf.Username, s.conf.Password)
+	}
+	if s.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.conf.BearerToken)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return &output.StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package output
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	retry_interval = time.Second
+	retry_max_time = 5 * time.Minute
+)
+
+// StatusError is returned by senders for a request the server answered
+// with a status other than 2xx.
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.Code, e.Body)
+}
+
+// IsPermanent reports whether the server rejected the data itself, so that
+// sending it again cannot succeed. Rate limits and authorization failures
+// are worth retrying, the latter once the server or the config is fixed.
+func IsPermanent(err error) bool {
+	if e, ok := err.(*StatusError); ok {
+		return e.Code >= 400 && e.Code < 500 && e.Code != http.StatusTooManyRequests &&
+			e.Code != http.StatusUnauthorized && e.Code != http.StatusForbidden
+	}
+	return false
+}
+
+// Spool sends records in order through Send. Records it could not send are
+// kept in Buffer and sent first, oldest first, once sending succeeds again.
+// While sending fails, it retries with exponential backoff. It is not safe
+// for concurrent use, outputs call it from their sending goroutine.
+type Spool struct {
+	// Name of the output in the logs, e.g. "InfluxDB".
+	Name   string
+	Buffer *Buffer
+	// Send sends records joined into one request.
+	Send func(records [][]byte) error
+	// BatchSize is the number of buffered records joined into one request.
+	BatchSize int
+
+	failing bool
+	wait    time.Duration
+	retryAt time.Time
+}
+
+// Flush sends the buffered records and then rec, if not nil. During the
+// backoff it only buffers rec, unless force is set, e.g. on shutdown.
+func (s *Spool) Flush(rec []byte, force bool) {
+	if s.failing && !force && time.Now().Before(s.retryAt) {
+		s.store(rec)
+		return
+	}
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	for {
+		batch := s.Buffer.PeekN(batchSize)
+		if len(batch) == 0 {
+			break
+		}
+		if !s.send(batch) {
+			s.store(rec)
+			return
+		}
+		if err := s.Buffer.PopN(len(batch)); err != nil {
+			log.Printf("%s buffer error: %v\n", s.Name, err)
+		}
+	}
+	if rec != nil && !s.send([][]byte{rec}) {
+		s.store(rec)
+	}
+}
+
+// Failing reports whether the last send failed.
+func (s *Spool) Failing() bool {
+	return s.failing
+}
+
+// send reports whether the records are done with, or have to be sent again
+// later.
+func (s *Spool) send(records [][]byte) bool {
+	err := s.Send(records)
+	switch {
+	case err == nil:
+		if s.failing {
+			log.Printf("%s send recovered\n", s.Name)
+			s.failing = false
+		}
+		s.wait = 0
+		return true
+	case IsPermanent(err):
+		// retrying records the server rejects would block the others
+		log.Printf("%s rejected %d records, dropping them: %v\n", s.Name, len(records), err)
+		return true
+	}
+	if !s.failing {
+		log.Printf("%s send failed, buffering: %v\n", s.Name, err)
+		s.failing = true
+	}
+	if s.wait *= 2; s.wait < retry_interval {
+		s.wait = retry_interval
+	} else if s.wait > retry_max_time {
+		s.wait = retry_max_time
+	}
+	s.retryAt = time.Now().Add(s.wait)
+	return false
+}
+
+func (s *Spool) store(rec []byte) {
+	if rec == nil {
+		return
+	}
+	if n, err := s.Buffer.Push(rec); err != nil {
+		log.Printf("%s buffer error: %v\n", s.Name, err)
+	} else if n > 0 {
+		log.Printf("%s buffer is full, dropped the %d oldest records\n", s.Name, n)
+	}
+}
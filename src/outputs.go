@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+)
+
+// checkOutputs returns an error if enable_output names an unknown output.
+func checkOutputs(names []string) error {
+	for _, name := range names {
+		if _, err := output.LookupDriver(name); err != nil {
+			return fmt.Errorf("enable_output %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// startOutput starts the output name, stopping the running one first:
+// sinks own their buffer and log files, which the new one opens.
+func startOutput(name string) error {
+	d, err := output.LookupDriver(name)
+	if err != nil {
+		return err
+	}
+	output.Stop(name)
+	s, err := d.New()
+	if err != nil {
+		return err
+	}
+	output.Start(name, s)
+	log.Printf("Started output %s\n", name)
+	return nil
+}
+
+// initOutputs starts the enabled outputs before the pollers produce the
+// first readings.
+func initOutputs() error {
+	output.Gatherer = reg
+	if err := checkOutputs(conf.EnabledOutputs); err != nil {
+		return err
+	}
+	for _, name := range conf.EnabledOutputs {
+		if err := startOutput(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadOutputs stops the outputs no longer enabled and restarts the ones
+// whose section or state_dir changed. newConfig must already be set.
+func reloadOutputs(oldConfig, newConfig config.Config) error {
+	enabled := map[string]bool{}
+	for _, name := range newConfig.Default.EnabledOutputs {
+		enabled[name] = true
+	}
+	running := map[string]bool{}
+	for _, name := range output.Running() {
+		running[name] = true
+		if !enabled[name] {
+			output.Stop(name)
+			log.Printf("Stopped output %s\n", name)
+		}
+	}
+	for _, name := range newConfig.Default.EnabledOutputs {
+		if running[name] && oldConfig.Default.StateDir == newConfig.Default.StateDir &&
+			!config.SectionChanged(oldConfig, newConfig, name) {
+			continue
+		}
+		if err := startOutput(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopOutputs closes the outputs, sending what they still have queued.
+func stopOutputs() {
+	for _, name := range output.Running() {
+		output.Stop(name)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+)
+
+func loadConf(t *testing.T, dir, name, influxURL string, flush time.Duration) config.Config {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	data := fmt.Sprintf(`[default]
+state_dir = %s
+enable_output = influxdb
+
+[influxdb]
+url = %s
+flush_interval = %v
+`, dir, influxURL, flush)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReloadOutputKeepsBuffer(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	var mu sync.Mutex
+	var received []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer up.Close()
+
+	dir := t.TempDir()
+	first := loadConf(t, dir, "first.conf", down.URL, time.Hour)
+	second := loadConf(t, dir, "second.conf", up.URL, 50*time.Millisecond)
+	config.Set(first)
+	setConf(first.Default)
+	t.Cleanup(func() {
+		stopOutputs()
+		config.Set(config.Config{})
+		setConf(config.Default{})
+	})
+	if err := startOutput("influxdb"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a batch is buffered while the server is down, the next one is still
+	// queued when the output is restarted with the other url: the old sink
+	// buffers it on Close, and the new one sends both
+	const n = 20
+	for i := 0; i < n; i++ {
+		if i == n/2 {
+			output.Stop("influxdb")
+			if err := startOutput("influxdb"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		output.Write(output.Reading{
+			Instance:   "bme280",
+			SensorName: "BME280",
+			Values:     map[string]float64{"temperature": float64(i)},
+			Time:       time.Unix(int64(i), 0),
+		})
+	}
+	config.Set(second)
+	setConf(second.Default)
+	if err := reloadOutputs(first, second); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := len(received)
+		mu.Unlock()
+		if got >= n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d readings sent after the reload", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	seen := map[string]bool{}
+	for _, line := range received {
+		seen[line] = true
+	}
+	for i := 0; i < n; i++ {
+		line := fmt.Sprintf("bme280,host=%s,instance=bme280,sensor_name=BME280 temperature=%d %d", second.Influxdb.Host, i, int64(i)*1e9)
+		if !seen[line] {
+			t.Errorf("reading %d lost: %q", i, line)
+		}
+	}
+}
+
+func TestReloadOutputStateDir(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	var list []config.Config
+	for _, dir := range []string{t.TempDir(), t.TempDir()} {
+		list = append(list, loadConf(t, dir, "sensor-exporter.conf", srv.URL, time.Hour))
+	}
+	first, second := list[0], list[1]
+	config.Set(first)
+	setConf(first.Default)
+	t.Cleanup(func() {
+		stopOutputs()
+		config.Set(config.Config{})
+		setConf(config.Default{})
+	})
+	if err := startOutput("influxdb"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the [influxdb] section is the same, but the reading is buffered in
+	// the new state_dir
+	if config.SectionChanged(first, second, "influxdb") {
+		t.Fatal("[influxdb] changed")
+	}
+	config.Set(second)
+	setConf(second.Default)
+	if err := reloadOutputs(first, second); err != nil {
+		t.Fatal(err)
+	}
+	output.Write(output.Reading{Instance: "bme280", SensorName: "BME280", Values: map[string]float64{"temperature": 21}, Time: time.Now()})
+	stopOutputs()
+	if _, err := os.Stat(second.Influxdb.BufferFile); err != nil {
+		t.Errorf("buffer not moved to the new state_dir: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// point maps a raw value to its corrected value.
+type point struct {
+	raw, value float64
+}
+
+// correction of one metrics: value = scale * table(raw) + offset
+type metricsCorrection struct {
+	table  []point
+	scale  float64
+	offset float64
+}
+
+// Correction corrects the readings of a sensor against a reference with the
+// offset_, scale_ and correction_ keys of the metrics.
+type Correction struct {
+	metrics   map[string]metricsCorrection
+	exportRaw bool
+}
+
+func newCorrection(sec *ini.Section) (*Correction, error) {
+	c := &Correction{
+		metrics:   map[string]metricsCorrection{},
+		exportRaw: sec.Key("export_raw").MustBool(false),
+	}
+	get := func(name string) metricsCorrection {
+		if m, ok := c.metrics[name]; ok {
+			return m
+		}
+		return metricsCorrection{scale: 1}
+	}
+	for name, key := range metricsKeys(sec, "offset_") {
+		m := get(name)
+		offset, err := key.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %s: invalid offset %q", sec.Name(), key.Name(), key.String())
+		}
+		m.offset = offset
+		c.metrics[name] = m
+	}
+	for name, key := range metricsKeys(sec, "scale_") {
+		m := get(name)
+		scale, err := key.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %s: invalid scale %q", sec.Name(), key.Name(), key.String())
+		}
+		m.scale = scale
+		c.metrics[name] = m
+	}
+	for name, key := range metricsKeys(sec, "correction_") {
+		m := get(name)
+		table, err := parseTable(key.String())
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %s: %v", sec.Name(), key.Name(), err)
+		}
+		m.table = table
+		c.metrics[name] = m
+	}
+	if len(c.metrics) == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// CheckTable validates a correction table.
+func CheckTable(value string) error {
+	_, err := parseTable(value)
+	return err
+}
+
+// parseTable parses a correction table "raw:value, raw:value, ..." of at
+// least two points.
+func parseTable(s string) ([]point, error) {
+	table := []point{}
+	for _, field := range strings.Split(s, ",") {
+		pair := strings.Split(strings.TrimSpace(field), ":")
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid point %q, expected raw:value", strings.TrimSpace(field))
+		}
+		raw, err1 := strconv.ParseFloat(strings.TrimSpace(pair[0]), 64)
+		value, err2 := strconv.ParseFloat(strings.TrimSpace(pair[1]), 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid point %q, expected raw:value", strings.TrimSpace(field))
+		}
+		table = append(table, point{raw: raw, value: value})
+	}
+	if len(table) < 2 {
+		return nil, fmt.Errorf("a correction table needs at least two points")
+	}
+	sort.Slice(table, func(i, j int) bool { return table[i].raw < table[j].raw })
+	for i := 1; i < len(table); i++ {
+		if table[i].raw == table[i-1].raw {
+			return nil, fmt.Errorf("raw value %v is listed twice", table[i].raw)
+		}
+	}
+	return table, nil
+}
+
+// interpolate maps raw linearly between the points of the table around it,
+// extrapolating with the first or last segment outside of the table.
+func interpolate(table []point, raw float64) float64 {
+	i := sort.Search(len(table), func(i int) bool { return table[i].raw >= raw })
+	if i == 0 {
+		i = 1
+	}
+	if i == len(table) {
+		i = len(table) - 1
+	}
+	a, b := table[i-1], table[i]
+	return a.value + (raw-a.raw)*(b.value-a.value)/(b.raw-a.raw)
+}
+
+func (c *Correction) Process(data map[string]float64, t time.Time) {
+	raws := map[string]float64{}
+	for name, raw := range data {
+		if _, ok := c.metrics[strings.ToLower(name)]; ok {
+			raws[name] = raw
+		}
+	}
+	for name, raw := range raws {
+		m := c.metrics[strings.ToLower(name)]
+		value := raw
+		if m.table != nil {
+			value = interpolate(m.table, value)
+		}
+		data[name] = m.scale*value + m.offset
+		if c.exportRaw {
+			data[name+"_raw"] = raw
+		}
+	}
+}
+
+func (c *Correction) Describe(desc map[string]string) {
+	if !c.exportRaw {
+		return
+	}
+	raws := map[string]string{}
+	for name, help := range desc {
+		if _, ok := c.metrics[strings.ToLower(name)]; ok {
+			raws[name+"_raw"] = help + ", before correction"
+		}
+	}
+	for name, help := range raws {
+		desc[name] = help
+	}
+}
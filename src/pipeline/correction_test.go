@@ -0,0 +1,133 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+func section(t *testing.T, keys string) *ini.Section {
+	t.Helper()
+	cfg, err := ini.Load([]byte("[bme280]\n" + keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Section("bme280")
+}
+
+func TestParseTable(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want []point
+		err  string
+	}{
+		{"0:1, 100:99", []point{{0, 1}, {100, 99}}, ""},
+		// the points are sorted by raw value
+		{" 50 : 48 ,0:1,100:99", []point{{0, 1}, {50, 48}, {100, 99}}, ""},
+		{"-10:-9.5, 1e2:101", []point{{-10, -9.5}, {100, 101}}, ""},
+		{"0:1, 50:48, 0:2", nil, "listed twice"},
+		{"0:1", nil, "at least two points"},
+		{"", nil, "expected raw:value"},
+		{"0:1, 100", nil, `invalid point "100"`},
+		{"0:1, 100:99:98", nil, `invalid point "100:99:98"`},
+		{"0:1, x:99", nil, `invalid point "x:99"`},
+		{"0:1,, 100:99", nil, `invalid point ""`},
+	} {
+		got, err := parseTable(tc.s)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("parseTable(%q) error = %v, want %q", tc.s, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tc.want) {
+			t.Errorf("parseTable(%q) = %v, %v, want %v", tc.s, got, err, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("parseTable(%q) = %v, want %v", tc.s, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	table := []point{{0, 2}, {10, 12}, {20, 32}}
+	for _, tc := range []struct {
+		raw, want float64
+	}{
+		{0, 2},
+		{5, 7},
+		{10, 12},
+		{15, 22},
+		{20, 32},
+		// outside of the table the first and last segments go on
+		{-5, -3},
+		{30, 52},
+	} {
+		if got := interpolate(table, tc.raw); got != tc.want {
+			t.Errorf("interpolate(%v) = %v, want %v", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestCorrectionProcess(t *testing.T) {
+	c, err := newCorrection(section(t, `
+offset_temperature = -0.5
+scale_humidity = 1.5
+correction_pressure = 900:905, 1100:1095
+offset_pressure = 1
+scale_pressure = 2
+export_raw = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]float64{"Temperature": 24, "humidity": 50, "pressure": 1000, "co2": 400}
+	c.Process(data, time.Now())
+	want := map[string]float64{
+		"Temperature": 23.5, "Temperature_raw": 24,
+		"humidity": 75, "humidity_raw": 50,
+		// 2 * 1000 on the table + 1
+		"pressure": 2001, "pressure_raw": 1000,
+		"co2": 400,
+	}
+	if len(data) != len(want) {
+		t.Errorf("Process = %v, want %v", data, want)
+	}
+	for name, v := range want {
+		if data[name] != v {
+			t.Errorf("%s = %v, want %v", name, data[name], v)
+		}
+	}
+
+	desc := map[string]string{"Temperature": "Temperature [°C]", "co2": "CO2 [ppm]"}
+	c.Describe(desc)
+	if desc["Temperature_raw"] != "Temperature [°C], before correction" || len(desc) != 3 {
+		t.Errorf("Describe = %v", desc)
+	}
+
+	// without export_raw only the corrected values are kept
+	c, err = newCorrection(section(t, "offset_temperature = -0.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = map[string]float64{"temperature": 24}
+	c.Process(data, time.Now())
+	if len(data) != 1 || data["temperature"] != 23.5 {
+		t.Errorf("Process without export_raw = %v", data)
+	}
+
+	for _, keys := range []string{"offset_temperature = x", "scale_temperature = 1,5", "correction_temperature = 0:1"} {
+		if _, err := newCorrection(section(t, keys)); err == nil {
+			t.Errorf("newCorrection(%q) accepted", keys)
+		}
+	}
+	if c, err := newCorrection(section(t, "export_raw = true")); c != nil || err != nil {
+		t.Errorf("newCorrection without corrections = %v, %v, want nil", c, err)
+	}
+}
@@ -0,0 +1,195 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+var (
+	// Spikes rejected in a row before the new level is taken as real
+	max_rejected_spikes = 3
+)
+
+// smoother smooths the values of one metrics.
+type smoother interface {
+	add(value float64) float64
+}
+
+// sma is the simple moving average over the last n values.
+type sma struct {
+	n      int
+	values []float64
+	sum    float64
+}
+
+func (s *sma) add(value float64) float64 {
+	s.values = append(s.values, value)
+	s.sum += value
+	if len(s.values) > s.n {
+		s.sum -= s.values[0]
+		s.values = s.values[1:]
+	}
+	return s.sum / float64(len(s.values))
+}
+
+// ema is the exponential moving average with weight alpha of a new value.
+type ema struct {
+	alpha float64
+	value float64
+	init  bool
+}
+
+func (e *ema) add(value float64) float64 {
+	if !e.init {
+		e.value = value
+		e.init = true
+		return value
+	}
+	e.value = e.alpha*value + (1-e.alpha)*e.value
+	return e.value
+}
+
+// median is the median of the last n values.
+type median struct {
+	n      int
+	values []float64
+}
+
+func (m *median) add(value float64) float64 {
+	m.values = append(m.values, value)
+	if len(m.values) > m.n {
+		m.values = m.values[1:]
+	}
+	sorted := append([]float64{}, m.values...)
+	sort.Float64s(sorted)
+	i := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[i-1] + sorted[i]) / 2
+	}
+	return sorted[i]
+}
+
+// spikeFilter rejects values changing faster than maxRate per second from
+// the last accepted one, unless the change persists.
+type spikeFilter struct {
+	maxRate  float64
+	last     float64
+	lastTime time.Time
+	rejected int
+}
+
+func (s *spikeFilter) add(value float64, t time.Time) (float64, bool) {
+	if !s.lastTime.IsZero() && s.rejected < max_rejected_spikes {
+		dt := t.Sub(s.lastTime).Seconds()
+		if dt > 0 && math.Abs(value-s.last)/dt > s.maxRate {
+			s.rejected++
+			return s.last, false
+		}
+	}
+	s.last = value
+	s.lastTime = t
+	s.rejected = 0
+	return value, true
+}
+
+type metricsFilter struct {
+	spike  *spikeFilter
+	smooth smoother
+	value  float64 // last output
+}
+
+// Filter rejects spikes and smooths metrics with the max_rate_ and smooth_
+// keys of the metrics.
+type Filter struct {
+	metrics map[string]*metricsFilter
+}
+
+func newFilter(sec *ini.Section) (*Filter, error) {
+	f := &Filter{metrics: map[string]*metricsFilter{}}
+	get := func(name string) *metricsFilter {
+		if _, ok := f.metrics[name]; !ok {
+			f.metrics[name] = &metricsFilter{}
+		}
+		return f.metrics[name]
+	}
+	for name, key := range metricsKeys(sec, "max_rate_") {
+		rate, err := key.Float64()
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("[%s] %s: invalid rate %q", sec.Name(), key.Name(), key.String())
+		}
+		get(name).spike = &spikeFilter{maxRate: rate}
+	}
+	for name, key := range metricsKeys(sec, "smooth_") {
+		s, err := parseSmoother(key.String())
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %s: %v", sec.Name(), key.Name(), err)
+		}
+		get(name).smooth = s
+	}
+	if len(f.metrics) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// CheckSmoother validates a smoothing filter.
+func CheckSmoother(value string) error {
+	_, err := parseSmoother(value)
+	return err
+}
+
+// parseSmoother parses "sma:<n>", "ema:<alpha>" or "median:<n>".
+func parseSmoother(s string) (smoother, error) {
+	pair := strings.Split(s, ":")
+	if len(pair) != 2 {
+		return nil, fmt.Errorf("invalid filter %q, expected sma:<n>, ema:<alpha> or median:<n>", s)
+	}
+	kind, arg := strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])
+	switch kind {
+	case "sma", "median":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid number of samples %q", arg)
+		}
+		if kind == "sma" {
+			return &sma{n: n}, nil
+		}
+		return &median{n: n}, nil
+	case "ema":
+		alpha, err := strconv.ParseFloat(arg, 64)
+		if err != nil || alpha <= 0 || alpha > 1 {
+			return nil, fmt.Errorf("invalid alpha %q, expected 0 < alpha <= 1", arg)
+		}
+		return &ema{alpha: alpha}, nil
+	}
+	return nil, fmt.Errorf("unknown filter %q, expected sma, ema or median", kind)
+}
+
+func (f *Filter) Process(data map[string]float64, t time.Time) {
+	for name, value := range data {
+		m, ok := f.metrics[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		if m.spike != nil {
+			if _, accepted := m.spike.add(value, t); !accepted {
+				// repeat the last output, keeping the spike out of the smoother
+				data[name] = m.value
+				continue
+			}
+		}
+		if m.smooth != nil {
+			value = m.smooth.add(value)
+		}
+		m.value = value
+		data[name] = value
+	}
+}
+
+func (f *Filter) Describe(desc map[string]string) {}
@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSmoothers(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		in     []float64
+		want   []float64
+	}{
+		// the average of the values so far, then of the last 3
+		{"sma:3", []float64{3, 6, 9, 12, 3}, []float64{3, 4.5, 6, 9, 8}},
+		{"sma:1", []float64{3, 6, 9}, []float64{3, 6, 9}},
+		// the first value starts the average
+		{"ema:0.5", []float64{10, 20, 20, 0}, []float64{10, 15, 17.5, 8.75}},
+		{"ema:1", []float64{10, 20, 0}, []float64{10, 20, 0}},
+		// an even window averages the middle values
+		{"median:3", []float64{5, 1, 100, 2, 3, 3}, []float64{5, 3, 5, 2, 3, 3}},
+		{"median:4", []float64{4, 1, 3, 100, 2}, []float64{4, 2.5, 3, 3.5, 2.5}},
+	} {
+		s, err := parseSmoother(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range tc.in {
+			if got := s.add(v); math.Abs(got-tc.want[i]) > 1e-9 {
+				t.Errorf("%s: value %d = %v, want %v", tc.filter, i, got, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestParseSmoother(t *testing.T) {
+	for _, s := range []string{"sma", "sma:0", "median:-1", "median:x", "ema:0", "ema:1.5", "ema:x", "mean:3", "sma:3:4"} {
+		if _, err := parseSmoother(s); err == nil {
+			t.Errorf("parseSmoother(%q) accepted", s)
+		}
+	}
+	if _, err := parseSmoother(" ema : 0.2 "); err != nil {
+		t.Errorf("parseSmoother with spaces = %v", err)
+	}
+}
+
+func TestSpikeFilter(t *testing.T) {
+	start := time.Date(2023, 10, 17, 0, 0, 0, 0, time.UTC)
+	s := &spikeFilter{maxRate: 1}
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * 10 * time.Second) }
+	check := func(i int, value, want float64, accepted bool) {
+		t.Helper()
+		got, ok := s.add(value, at(i))
+		if got != want || ok != accepted {
+			t.Errorf("value %d: add(%v) = %v, %v, want %v, %v", i, value, got, ok, want, accepted)
+		}
+	}
+
+	check(0, 20, 20, true)
+	// 5 in 10s is within the rate
+	check(1, 25, 25, true)
+	// a single spike is rejected, the last value is kept
+	check(2, 80, 25, false)
+	check(3, 26, 26, true)
+
+	// a step change is rejected max_rejected_spikes times, then accepted
+	for i := 0; i < max_rejected_spikes; i++ {
+		check(4+i, 60, 26, false)
+	}
+	check(4+max_rejected_spikes, 60, 60, true)
+	check(5+max_rejected_spikes, 61, 61, true)
+}
+
+func TestFilterProcess(t *testing.T) {
+	f, err := newFilter(section(t, "max_rate_temperature = 1\nsmooth_temperature = sma:2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, 10, 17, 0, 0, 0, 0, time.UTC)
+	for i, tc := range []struct {
+		in, want float64
+	}{
+		{20, 20},
+		{22, 21},
+		// the spike repeats the last output and is kept out of the average
+		{90, 21},
+		{24, 23},
+	} {
+		data := map[string]float64{"Temperature": tc.in, "humidity": 50}
+		f.Process(data, start.Add(time.Duration(i)*10*time.Second))
+		if data["Temperature"] != tc.want || data["humidity"] != 50 {
+			t.Errorf("reading %d = %v, want temperature %v", i, data, tc.want)
+		}
+	}
+
+	for _, keys := range []string{"max_rate_temperature = 0", "max_rate_temperature = x", "smooth_temperature = sma:0"} {
+		if _, err := newFilter(section(t, keys)); err == nil {
+			t.Errorf("newFilter(%q) accepted", keys)
+		}
+	}
+}
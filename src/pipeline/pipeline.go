@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Stage processes the readings of a sensor between Sensor.Update and the
+// exporter.
+type Stage interface {
+	// Process changes data in place. t is the time of the reading.
+	Process(data map[string]float64, t time.Time)
+	// Describe adds the descriptions of the metrics the stage adds.
+	Describe(desc map[string]string)
+}
+
+// Pipeline is the list of stages a reading goes through, in order.
+type Pipeline []Stage
+
+// New builds the pipeline configured in a sensor section. derive, if not
+// nil, runs between the correction and the filters, so that metrics derived
+// from others use the corrected values and can be filtered themselves.
+func New(sec *ini.Section, derive Stage) (Pipeline, error) {
+	p := Pipeline{}
+	correction, err := newCorrection(sec)
+	if err != nil {
+		return nil, err
+	}
+	if correction != nil {
+		p = append(p, correction)
+	}
+	if derive != nil {
+		p = append(p, derive)
+	}
+	filter, err := newFilter(sec)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		p = append(p, filter)
+	}
+	return p, nil
+}
+
+// Process returns a copy of data run through the stages. The data of the
+// driver is not changed, since drivers keep it between reads.
+func (p Pipeline) Process(data map[string]float64, t time.Time) map[string]float64 {
+	out := make(map[string]float64, len(data))
+	for k, v := range data {
+		out[k] = v
+	}
+	for _, stage := range p {
+		stage.Process(out, t)
+	}
+	return out
+}
+
+// Describe returns a copy of desc with the metrics the stages add.
+func (p Pipeline) Describe(desc map[string]string) map[string]string {
+	out := make(map[string]string, len(desc))
+	for k, v := range desc {
+		out[k] = v
+	}
+	for _, stage := range p {
+		stage.Describe(out)
+	}
+	return out
+}
+
+// metricsKeys returns the values of the keys prefix<metrics> of sec by
+// metrics name. Key names are lower case, so are the metrics names.
+func metricsKeys(sec *ini.Section, prefix string) map[string]*ini.Key {
+	keys := map[string]*ini.Key{}
+	for _, key := range sec.Keys() {
+		if strings.HasPrefix(key.Name(), prefix) && len(key.Name()) > len(prefix) {
+			keys[strings.TrimPrefix(key.Name(), prefix)] = key
+		}
+	}
+	return keys
+}
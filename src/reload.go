@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"sensor-exporter/config"
+	"sensor-exporter/pipeline"
+	"sensor-exporter/sensor"
+)
+
+var (
+	// conf and pollers are replaced by reloadConfig in the main goroutine,
+	// other goroutines read them through getConf and getPollers
+	confMu    sync.RWMutex
+	pollersMu sync.RWMutex
+
+	// reload requests from the HTTP endpoint, served by the main goroutine
+	reloadCh = make(chan chan error)
+)
+
+func getConf() config.Default {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return conf
+}
+
+func setConf(c config.Default) {
+	confMu.Lock()
+	defer confMu.Unlock()
+	conf = c
+}
+
+func getPollers() []*poller {
+	pollersMu.RLock()
+	defer pollersMu.RUnlock()
+	return append([]*poller{}, pollers...)
+}
+
+func setPollers(list []*poller) {
+	pollersMu.Lock()
+	defer pollersMu.Unlock()
+	pollers = list
+}
+
+// getDescriptions returns the descriptions of the metrics of every sensor,
+// including the metrics added by their pipelines.
+func getDescriptions() []map[string]string {
+	list := []map[string]string{}
+	for _, p := range getPollers() {
+		list = append(list, p.pipeline.Describe(p.sensor.GetMetricsDescriptions()))
+	}
+	return list
+}
+
+// initSensors creates a poller for every enabled sensor. The pollers are
+// started once the exporter is initialized.
+func initSensors() error {
+	list, err := sensor.Init(conf.EnabledSensors)
+	if err != nil {
+		return err
+	}
+	created := []*poller{}
+	for _, s := range list {
+		p, err := newPoller(s)
+		if err != nil {
+			return err
+		}
+		created = append(created, p)
+	}
+	setPollers(created)
+	updateConsoleHeader()
+	return nil
+}
+
+// reloadConfig reads the config file again. Sensors whose sections did not
+// change keep running, the others are stopped, and new or changed ones are
+// initialized from the new config.
+func reloadConfig() error {
+	newConfig, err := config.Load(confPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range newConfig.Default.EnabledSensors {
+		if _, err := sensor.LookupDriver(config.SensorType(name)); err != nil {
+			return fmt.Errorf("enable_sensor %s: %v", name, err)
+		}
+		if _, err := pipeline.New(newConfig.Section(name), nil); err != nil {
+			return err
+		}
+	}
+	if err := checkOutputs(newConfig.Default.EnabledOutputs); err != nil {
+		return err
+	}
+	oldConfig := config.GetConfig()
+	if oldConfig.Default.BindIp != newConfig.Default.BindIp || oldConfig.Default.BindPort != newConfig.Default.BindPort {
+		log.Println("bind_ip and bind_port are not reloaded, restart to change them")
+	}
+	// sensors and outputs keep their state in state_dir
+	stateDirChanged := oldConfig.Default.StateDir != newConfig.Default.StateDir
+	if stateDirChanged {
+		log.Printf("state_dir changed to %q, restarting the sensors and outputs\n", newConfig.Default.StateDir)
+	}
+
+	// stop the pollers of removed and changed sensors first, so that the
+	// devices are released before a new instance opens them
+	current := map[string]*poller{}
+	for _, p := range getPollers() {
+		current[p.sensor.GetInstanceName()] = p
+	}
+	kept := map[string]*poller{}
+	for _, name := range newConfig.Default.EnabledSensors {
+		if p, ok := current[name]; ok && !stateDirChanged && !config.SectionChanged(oldConfig, newConfig, name) {
+			kept[name] = p
+			delete(current, name)
+		}
+	}
+	stopped := []*poller{}
+	for _, p := range current {
+		stopped = append(stopped, p)
+	}
+	stopPollers(stopped)
+	for _, p := range stopped {
+		p.dropMetrics()
+	}
+
+	config.Set(newConfig)
+	setConf(newConfig.Default)
+	if err := reloadOutputs(oldConfig, newConfig); err != nil {
+		log.Printf("Output reload error: %v\n", err)
+	}
+	next := []*poller{}
+	started := []*poller{}
+	for _, name := range newConfig.Default.EnabledSensors {
+		if p, ok := kept[name]; ok {
+			next = append(next, p)
+			continue
+		}
+		s, err := sensor.New(name)
+		if err != nil {
+			return err
+		}
+		p, err := newPoller(s)
+		if err != nil {
+			return err
+		}
+		next = append(next, p)
+		started = append(started, p)
+	}
+	setPollers(next)
+	reloadSensorMetrics()
+	for _, p := range started {
+		p.start()
+	}
+	updateConsoleHeader()
+
+	log.Printf("Reloaded config: %d sensors kept, %d stopped, %d started\n", len(kept), len(stopped), len(started))
+	return nil
+}
+
+func updateConsoleHeader() {
+	tmpHeaderData := []string{}
+	for _, p := range getPollers() {
+		tmpHeaderData = append(tmpHeaderData, p.sensor.GetConsoleHeader())
+	}
+	headerData = "|" + strings.Join(tmpHeaderData, "|") + "|"
+	headerCount = 0
+}
+
+// reloadHandler serves POST /-/reload, an admin endpoint like the sensor
+// commands. SIGHUP reloads the config without the admin token.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	errCh := make(chan error, 1)
+	select {
+	case reloadCh <- errCh:
+	case <-r.Context().Done():
+		return
+	}
+	if err := <-errCh; err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "config reloaded")
+}
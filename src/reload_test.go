@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sensor-exporter/config"
+)
+
+func TestReloadHandlerAuth(t *testing.T) {
+	t.Cleanup(func() { setConf(config.Default{}) })
+	// the main goroutine answers the reload requests
+	reloads := 0
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case errCh := <-reloadCh:
+				reloads++
+				errCh <- nil
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for _, tc := range []struct {
+		token  string
+		method string
+		auth   string
+		want   int
+	}{
+		// disabled without admin_token
+		{"", http.MethodPost, "", http.StatusNotFound},
+		{"", http.MethodPost, "Bearer ", http.StatusNotFound},
+		{"secret", http.MethodGet, "Bearer secret", http.StatusMethodNotAllowed},
+		{"secret", http.MethodPost, "", http.StatusUnauthorized},
+		{"secret", http.MethodPost, "Bearer other", http.StatusUnauthorized},
+		{"secret", http.MethodPost, "Bearer secret", http.StatusOK},
+	} {
+		setConf(config.Default{AdminToken: tc.token})
+		req := httptest.NewRequest(tc.method, "/-/reload", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		reloadHandler(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s with token %q and %q = %d, want %d", tc.method, tc.token, tc.auth, w.Code, tc.want)
+		}
+	}
+	if reloads != 1 {
+		t.Errorf("%d reloads, want 1", reloads)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"sensor-exporter/config"
+	"sensor-exporter/output"
+	"sensor-exporter/pipeline"
+	"sensor-exporter/sensor"
+)
+
+// poller initializes and reads one sensor on its own schedule. A sensor that
+// fails to init, or fails reconnect_after reads in a row, is closed and
+// initialized again with exponential backoff. The lock serializes the driver
+// calls with readers of the driver's data such as GetConsoleData.
+type poller struct {
+	mu          sync.Mutex
+	sensor      sensor.Sensor
+	pipeline    pipeline.Pipeline
+	interval    time.Duration
+	initialized bool
+	failures    int
+	err         error
+	lastSuccess time.Time
+	exported    []string
+	stale       bool
+	chip        []string // labels of the chip info metric, if any
+	reported    bool     // whether the outputs were told the health
+
+	// last successful reading, served by the collector in collect mode
+	reading map[string]float64
+	readAt  time.Time
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newPoller(s sensor.Sensor) (*poller, error) {
+	interval := config.GetConfig().Sensors[s.GetInstanceName()].PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	var derive pipeline.Stage
+	if d, ok := s.(sensor.Deriver); ok {
+		derive = deriveStage{d}
+	}
+	pl, err := pipeline.New(config.Section(s.GetInstanceName()), derive)
+	if err != nil {
+		return nil, err
+	}
+	return &poller{
+		sensor:      s,
+		pipeline:    pl,
+		interval:    interval,
+		lastSuccess: time.Now(),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// deriveStage runs the derivation of a sensor in its pipeline. The derived
+// metrics are already described by the sensor.
+type deriveStage struct {
+	sensor.Deriver
+}
+
+func (d deriveStage) Process(data map[string]float64, t time.Time) {
+	d.Derive(data, t)
+}
+
+func (d deriveStage) Describe(desc map[string]string) {}
+
+func (p *poller) start() {
+	go p.run()
+}
+
+// stopPollers stops the pollers and waits until they closed their sensors,
+// giving up after a while since a sensor may be in the middle of its init.
+func stopPollers(list []*poller) {
+	for _, p := range list {
+		close(p.quit)
+	}
+	timeout := time.After(10 * time.Second)
+	for _, p := range list {
+		select {
+		case <-p.done:
+		case <-timeout:
+			log.Println("Timed out waiting for sensors to stop")
+			return
+		}
+	}
+}
+
+func (p *poller) run() {
+	defer close(p.done)
+	defer p.close()
+	retry := getConf().RetryInterval
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-time.After(wait):
+		}
+		if !p.isInitialized() {
+			if err := p.init(); err != nil {
+				log.Printf("%s init error: %v, retry in %v\n", p.sensor.GetInstanceName(), err, retry)
+				wait = retry
+				retry = retry * 2
+				if retry > getConf().RetryMaxInterval {
+					retry = getConf().RetryMaxInterval
+				}
+				continue
+			}
+			retry = getConf().RetryInterval
+		}
+		// in collect mode the sensor is read when scraped, so only keep it
+		// initialized here
+		if getConf().ExporterMode != "collect" {
+			p.update()
+		}
+		wait = p.interval
+	}
+}
+
+func (p *poller) isInitialized() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.initialized
+}
+
+func (p *poller) init() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.sensor.Init(); err != nil {
+		// release whatever the driver opened before it failed
+		p.sensor.Close()
+		p.fail(err, time.Now())
+		return err
+	}
+	p.initialized = true
+	p.failures = 0
+	p.updateChipInfo()
+	return nil
+}
+
+// updateChipInfo exports the chip detected by Init, replacing the previous
+// one if the chip was swapped. It must be called with the lock held.
+func (p *poller) updateChipInfo() {
+	info, ok := p.sensor.(sensor.ChipInfo)
+	if !ok {
+		return
+	}
+	chip, id := info.Chip()
+	if p.chip != nil {
+		if p.chip[0] == chip && p.chip[1] == id {
+			return
+		}
+		deleteChipInfo(p.sensor, p.chip)
+	}
+	p.chip = []string{chip, id}
+	setChipInfo(p.sensor, p.chip)
+}
+
+func (p *poller) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sensor.Close()
+	p.initialized = false
+}
+
+func (p *poller) update() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.updateLocked()
+}
+
+func (p *poller) updateLocked() {
+	data, err := p.sensor.Update()
+	now := time.Now()
+	if err != nil {
+		if p.err == nil {
+			log.Printf("%s read error: %v\n", p.sensor.GetInstanceName(), err)
+		}
+		p.fail(err, now)
+		p.failures++
+		if reconnectAfter := getConf().ReconnectAfter; reconnectAfter > 0 && p.failures >= reconnectAfter {
+			log.Printf("%s failed %d reads in a row, reconnect\n", p.sensor.GetInstanceName(), p.failures)
+			p.sensor.Close()
+			p.initialized = false
+		}
+		return
+	}
+	if p.err != nil {
+		log.Printf("%s read recovered\n", p.sensor.GetInstanceName())
+	}
+	data = p.pipeline.Process(data, now)
+	setSensorHealth(p.sensor, nil, now)
+	if p.err != nil || !p.reported {
+		output.SetHealth(p.sensor.GetInstanceName(), p.sensor.GetSensorName(), true)
+		p.reported = true
+	}
+	p.err = nil
+	p.failures = 0
+	p.stale = false
+	p.lastSuccess = now
+	p.exported = p.exported[:0]
+	p.reading = make(map[string]float64, len(data))
+	p.readAt = now
+	for i, d := range data {
+		setExportValue(i, p.sensor, d)
+		p.exported = append(p.exported, i)
+		p.reading[i] = d
+	}
+	output.Write(output.Reading{
+		Instance:   p.sensor.GetInstanceName(),
+		SensorName: p.sensor.GetSensorName(),
+		Values:     p.reading,
+		Help:       p.pipeline.Describe(p.sensor.GetMetricsDescriptions()),
+		Time:       now,
+	})
+}
+
+// cachedReading returns the last reading, reading the sensor first if the
+// reading is older than maxAge. It reports false if there is no usable one.
+func (p *poller) cachedReading(maxAge time.Duration) (map[string]float64, time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.initialized && (p.reading == nil || time.Since(p.readAt) >= maxAge) {
+		p.updateLocked()
+	}
+	if p.reading == nil || p.stale {
+		return nil, time.Time{}, false
+	}
+	return p.reading, p.readAt, true
+}
+
+// fail records a failed init or read. It must be called with the lock held.
+func (p *poller) fail(err error, now time.Time) {
+	setSensorHealth(p.sensor, err, now)
+	if p.err == nil || !p.reported {
+		output.SetHealth(p.sensor.GetInstanceName(), p.sensor.GetSensorName(), false)
+		p.reported = true
+	}
+	p.err = err
+	staleAfter := getConf().StaleAfter
+	if staleAfter > 0 && !p.stale && now.Sub(p.lastSuccess) > staleAfter {
+		log.Printf("%s has no data for %v, drop its metrics\n", p.sensor.GetInstanceName(), staleAfter)
+		deleteExportValues(p.exported, p.sensor)
+		p.stale = true
+	}
+}
+
+var errNotInitialized = errors.New("sensor is not initialized")
+
+// command runs an administrative command of the sensor between two reads.
+func (p *poller) command(cmd sensor.Command, args []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.initialized {
+		return errNotInitialized
+	}
+	return cmd.Run(args)
+}
+
+// pollerStatus is a snapshot of the health and the last reading of a sensor.
+type pollerStatus struct {
+	initialized bool
+	err         error
+	lastSuccess time.Time
+	stale       bool
+	reading     map[string]float64
+	readAt      time.Time
+}
+
+func (p *poller) status() pollerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return pollerStatus{
+		initialized: p.initialized,
+		err:         p.err,
+		lastSuccess: p.lastSuccess,
+		stale:       p.stale,
+		reading:     p.reading,
+		readAt:      p.readAt,
+	}
+}
+
+func (p *poller) consoleData() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sensor.GetConsoleData()
+}
+
+// dropMetrics removes all series of the sensor of a stopped poller.
+func (p *poller) dropMetrics() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	deleteExportValues(p.exported, p.sensor)
+	deleteSensorHealth(p.sensor)
+	if p.chip != nil {
+		deleteChipInfo(p.sensor, p.chip)
+	}
+}
@@ -4,59 +4,80 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"sensor-exporter/bus/i2c"
 	"sensor-exporter/config"
-
-	"golang.org/x/exp/io/i2c"
+	"sensor-exporter/sensor"
+	"time"
 )
 
 var (
-	conf config.Bme280
+	// Register id (addr: 0xD0) and the chips it identifies
+	reg_chip_id = byte(0xD0)
+	chip_names  = map[byte]string{
+		0x60: "BME280",
+		0x56: "BMP280", // samples
+		0x57: "BMP280", // samples
+		0x58: "BMP280",
+	}
+
+	// Register reset (addr: 0xE0), reset by writing 0xB6
+	reg_reset  = byte(0xE0)
+	reset_word = byte(0xB6)
 
-	// Register ctrl_hum (addr: 0xF2)
+	// Register ctrl_hum (addr: 0xF2): osrs_h (3 bits)
 	reg_ctrl_hum = byte(0xF2)
-	osrs_h       = 1            // Humidity oversampling (3 bits)
-	num_ctrl_hum = byte(osrs_h) // write 00000001 to 0xF2
 
-	// Register ctrl_meas (addr: 0xF4)
+	// Register status (addr: 0xF3): measuring (bit 3), im_update (bit 0)
+	reg_status       = byte(0xF3)
+	status_measure   = byte(1 << 3)
+	status_im_update = byte(1 << 0)
+
+	// Register ctrl_meas (addr: 0xF4): osrs_t (3 bits), osrs_p (3 bits), mode (2 bits)
 	reg_ctrl_meas = byte(0xF4)
-	osrs_t        = 1                                          // Temperature oversampling (3 bits)
-	osrs_p        = 1                                          // Pressure oversampling (3 bits)
-	mode          = 3                                          // Normal mode (2 bits)
-	num_ctrl_meas = byte((osrs_t << 5) | (osrs_p << 2) | mode) // 3, 3, 2
+	mode_sleep    = byte(0)
+	mode_forced   = byte(1)
+	mode_normal   = byte(3)
 
-	// Register config (addr: 0xF5)
+	// Register config (addr: 0xF5): t_sb (3 bits), filter (3 bits), spi3w_en (1 bit)
 	reg_config = byte(0xF5)
-	t_sb       = 5                                            // Tstandby 1000ms (3 bits)
-	filter     = 3                                            // Filter off (3 bits)
-	spi3w_en   = 0                                            // Disable spi3w (1 bit)
-	num_config = byte((t_sb << 5) | (filter << 2) | spi3w_en) // 3, 3, 1(not used), 1
+
+	// Register values of the settings
+	osrs                = map[int]byte{1: 1, 2: 2, 4: 3, 8: 4, 16: 5}
+	filter_coefficients = map[int]byte{0: 0, 2: 1, 4: 2, 8: 3, 16: 4}
+	standby_times       = map[time.Duration]byte{
+		500 * time.Microsecond:   0,
+		62500 * time.Microsecond: 1,
+		125 * time.Millisecond:   2,
+		250 * time.Millisecond:   3,
+		500 * time.Millisecond:   4,
+		1000 * time.Millisecond:  5,
+		10 * time.Millisecond:    6,
+		20 * time.Millisecond:    7,
+	}
+	// the BMP280 has longer standby times for the codes 6 and 7
+	bmp280_standby_times = map[time.Duration]byte{
+		500 * time.Microsecond:   0,
+		62500 * time.Microsecond: 1,
+		125 * time.Millisecond:   2,
+		250 * time.Millisecond:   3,
+		500 * time.Millisecond:   4,
+		1000 * time.Millisecond:  5,
+		2000 * time.Millisecond:  6,
+		4000 * time.Millisecond:  7,
+	}
+
+	// Time to wait for a forced measurement beyond its typical duration
+	measure_timeout = 100 * time.Millisecond
+
+	// Time to wait for the chip to copy its calibration data after a reset
+	reset_time    = 2 * time.Millisecond
+	reset_timeout = 100 * time.Millisecond
 
 	// Addresses of calibration data
 	calib_addr1 = byte(0x88) // 24 bytes from here
 	calib_addr2 = byte(0xA1) // 1 byte from here
 	calib_addr3 = byte(0xE1) // 7 bytes from here
 
-	// Calibration data
-	calib_temp1  uint16
-	calib_temp2  int16
-	calib_temp3  int16
-	calib_humid1 uint8
-	calib_humid2 int16
-	calib_humid3 uint8
-	calib_humid4 int16
-	calib_humid5 int16
-	calib_humid6 int8
-	calib_press1 uint16
-	calib_press2 int16
-	calib_press3 int16
-	calib_press4 int16
-	calib_press5 int16
-	calib_press6 int16
-	calib_press7 int16
-	calib_press8 int16
-	calib_press9 int16
-	t_fine       int
-
 	// Addresses of measured value
 	temp_msb = byte(0xFA)
 	//temp_lsb  = byte(0xFB)
@@ -64,39 +85,109 @@ var (
 	//hum_lsb   = byte(0xFE)
 	press_msb = byte(0xF7)
 	//press_lsb = byte(0xF8)
-
-	bufTemp  = make([]byte, 3)
-	bufHumid = make([]byte, 2)
-	bufPress = make([]byte, 3)
 )
 
+func init() {
+	sensor.Register(sensor.Driver{
+		Name:        "bme280",
+		Description: "Bosch BME280 temperature, humidity and pressure sensor on I2C, also BMP280 without humidity",
+		ConfigKeys: []sensor.ConfigKey{
+			{Name: "i2c_device", Default: "/dev/i2c-1", Help: "I2C bus device"},
+			{Name: "i2c_address", Default: "0x76", Help: "I2C address of the sensor (0x76 or 0x77)", Kind: sensor.KindInt, Check: sensor.IntOneOf(0x76, 0x77)},
+			{Name: "metrics_name_temp", Default: "temperature", Help: "metrics name of the temperature in [°C]"},
+			{Name: "metrics_name_humid", Default: "humidity", Help: "metrics name of the humidity in [%]"},
+			{Name: "metrics_name_press", Default: "pressure", Help: "metrics name of the pressure in [hPa]"},
+			{Name: "metrics_name_dew_point", Default: "", Help: "metrics name of the dew point in [°C], empty to disable"},
+			{Name: "metrics_name_abs_humid", Default: "", Help: "metrics name of the absolute humidity in [g/m³], empty to disable"},
+			{Name: "metrics_name_heat_index", Default: "", Help: "metrics name of the heat index in [°C], empty to disable"},
+			{Name: "metrics_name_humidex", Default: "", Help: "metrics name of the humidex, empty to disable"},
+			{Name: "metrics_name_vpd", Default: "", Help: "metrics name of the vapour pressure deficit in [kPa], empty to disable"},
+			{Name: "metrics_name_altitude", Default: "", Help: "metrics name of the altitude in [m] from sea_level_pressure, empty to disable"},
+			{Name: "metrics_name_sea_level_press", Default: "", Help: "metrics name of the pressure at sea level in [hPa] from altitude, empty to disable"},
+			{Name: "sea_level_pressure", Default: "1013.25", Help: "pressure at sea level in [hPa] for metrics_name_altitude", Kind: sensor.KindFloat, Check: sensor.Positive},
+			{Name: "altitude", Default: "0", Help: "altitude of the sensor in [m] for metrics_name_sea_level_press", Kind: sensor.KindFloat, Check: sensor.FloatRange(-500, 9000)},
+			{Name: "mode", Default: "normal", Help: "normal: measure continuously, forced: measure once per poll, which heats the sensor less", Check: sensor.OneOf("normal", "forced")},
+			{Name: "oversampling_temp", Default: "1", Help: "temperature oversampling (1, 2, 4, 8 or 16)", Kind: sensor.KindInt, Check: sensor.OneOf("1", "2", "4", "8", "16")},
+			{Name: "oversampling_humid", Default: "1", Help: "humidity oversampling (1, 2, 4, 8 or 16)", Kind: sensor.KindInt, Check: sensor.OneOf("1", "2", "4", "8", "16")},
+			{Name: "oversampling_press", Default: "1", Help: "pressure oversampling (1, 2, 4, 8 or 16)", Kind: sensor.KindInt, Check: sensor.OneOf("1", "2", "4", "8", "16")},
+			{Name: "filter", Default: "8", Help: "IIR filter coefficient (0 for off, 2, 4, 8 or 16)", Kind: sensor.KindInt, Check: sensor.OneOf("0", "2", "4", "8", "16")},
+			{Name: "standby", Default: "1s", Help: "standby time between measurements in normal mode (0.5ms, 62.5ms, 125ms, 250ms, 500ms or 1s, also 10ms or 20ms on BME280, 2s or 4s on BMP280)", Kind: sensor.KindDuration, Check: sensor.DurationOneOf(500*time.Microsecond, 10*time.Millisecond, 20*time.Millisecond, 62500*time.Microsecond, 125*time.Millisecond, 250*time.Millisecond, 500*time.Millisecond, time.Second, 2*time.Second, 4*time.Second)},
+		},
+		New: func(name string) sensor.Sensor { return New(name) },
+	})
+}
+
+// calibration holds the trimming parameters read from the chip.
+type calibration struct {
+	temp1  uint16
+	temp2  int16
+	temp3  int16
+	humid1 uint8
+	humid2 int16
+	humid3 uint8
+	humid4 int16
+	humid5 int16
+	humid6 int8
+	press1 uint16
+	press2 int16
+	press3 int16
+	press4 int16
+	press5 int16
+	press6 int16
+	press7 int16
+	press8 int16
+	press9 int16
+	t_fine int
+}
+
 type BME280 struct {
-	data map[string]float64
-	dev  *i2c.Device
+	name     string
+	conf     config.Bme280
+	calib    calibration
+	data     map[string]float64
+	dev      i2c.Device
+	ctrlMeas byte
+	chip     string // detected chip, BME280 or BMP280
+	chipID   byte
+
+	// Bus is used to open the device. If nil, the bus named by i2c_device is used.
+	Bus i2c.Bus
+}
+
+// New returns a driver for the sensor configured in section name.
+func New(name string) *BME280 {
+	return &BME280{name: name, conf: config.GetConfig().Bme280[name]}
 }
 
 func (b *BME280) Init() error {
-	conf = config.GetConfig().Bme280
-	log.Println("Open sensor BME280")
+	b.conf = config.GetConfig().Bme280[b.name]
+	log.Printf("Open sensor BME280 (%s)\n", b.name)
 
-	b.data = map[string]float64{
-		conf.TemperatureMetricsName: 0.0,
-		conf.HumidityMetricsName:    0.0,
-		conf.PressureMetricsName:    0.0,
+	bus := b.Bus
+	if bus == nil {
+		bus = i2c.Lookup(b.conf.I2cDevice)
 	}
-
-	dev, err := i2c.Open(&i2c.Devfs{Dev: conf.I2cDevice}, conf.I2cAddress)
+	dev, err := bus.Open(b.conf.I2cAddress)
 	if err != nil {
 		return err
 	}
 	b.dev = dev
-	if err := b.dev.WriteReg(reg_ctrl_hum, []byte{num_ctrl_hum}); err != nil {
+	if err := b.identify(); err != nil {
 		return err
 	}
-	if err := b.dev.WriteReg(reg_ctrl_meas, []byte{num_ctrl_meas}); err != nil {
+	if err := b.reset(); err != nil {
 		return err
 	}
-	if err := b.dev.WriteReg(reg_config, []byte{num_config}); err != nil {
+
+	b.data = map[string]float64{
+		b.conf.TemperatureMetricsName: 0.0,
+		b.conf.PressureMetricsName:    0.0,
+	}
+	if b.hasHumidity() {
+		b.data[b.conf.HumidityMetricsName] = 0.0
+	}
+
+	if err := b.configure(); err != nil {
 		return err
 	}
 	if err := b.InitCalibrationData(); err != nil {
@@ -106,6 +197,139 @@ func (b *BME280) Init() error {
 	return nil
 }
 
+// identify reads the chip id, so that a BMP280 or another device at the
+// address is not read as a BME280.
+func (b *BME280) identify() error {
+	id := make([]byte, 1)
+	if err := b.dev.ReadReg(reg_chip_id, id); err != nil {
+		return err
+	}
+	chip, ok := chip_names[id[0]]
+	if !ok {
+		return fmt.Errorf("unknown chip id 0x%02x at 0x%x, expected BME280 (0x60) or BMP280 (0x56, 0x57, 0x58)", id[0], b.conf.I2cAddress)
+	}
+	if chip != b.chip {
+		log.Printf("%s: detected %s (chip id 0x%02x)\n", b.name, chip, id[0])
+	}
+	b.chip = chip
+	b.chipID = id[0]
+	return nil
+}
+
+// reset soft resets the chip and waits until it loaded its calibration data.
+func (b *BME280) reset() error {
+	if err := b.dev.WriteReg(reg_reset, []byte{reset_word}); err != nil {
+		return err
+	}
+	time.Sleep(reset_time)
+	deadline := time.Now().Add(reset_timeout)
+	status := make([]byte, 1)
+	for {
+		if err := b.dev.ReadReg(reg_status, status); err != nil {
+			return err
+		}
+		if status[0]&status_im_update == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("chip not ready %v after reset", reset_time+reset_timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// hasHumidity reports whether the chip measures humidity. It is assumed
+// until the chip is identified.
+func (b *BME280) hasHumidity() bool {
+	return b.chip != "BMP280"
+}
+
+// Chip returns the chip detected by Init.
+func (b *BME280) Chip() (string, string) {
+	return b.chip, fmt.Sprintf("0x%02x", b.chipID)
+}
+
+// configure writes the measurement settings. In forced mode the chip is
+// left in sleep mode until Update triggers a measurement.
+func (b *BME280) configure() error {
+	osrs_t, ok_t := osrs[b.conf.OversamplingTemp]
+	osrs_h, ok_h := osrs[b.conf.OversamplingHumid]
+	osrs_p, ok_p := osrs[b.conf.OversamplingPress]
+	if !ok_t || !ok_h || !ok_p {
+		return fmt.Errorf("oversampling must be 1, 2, 4, 8 or 16")
+	}
+	filter, ok := filter_coefficients[b.conf.Filter]
+	if !ok {
+		return fmt.Errorf("filter %d is not one of 0, 2, 4, 8, 16", b.conf.Filter)
+	}
+	times := standby_times
+	if !b.hasHumidity() {
+		times = bmp280_standby_times
+	}
+	t_sb, ok := times[b.conf.Standby]
+	if !ok {
+		return fmt.Errorf("standby %v is not a standby time of %s", b.conf.Standby, b.chip)
+	}
+	mode := mode_normal
+	switch b.conf.Mode {
+	case "normal":
+	case "forced":
+		mode = mode_sleep
+	default:
+		return fmt.Errorf("mode %q is not one of normal, forced", b.conf.Mode)
+	}
+
+	// ctrl_hum takes effect with the following write of ctrl_meas, and
+	// config is only written reliably in sleep mode
+	b.ctrlMeas = osrs_t<<5 | osrs_p<<2
+	if err := b.dev.WriteReg(reg_ctrl_meas, []byte{b.ctrlMeas | mode_sleep}); err != nil {
+		return err
+	}
+	if b.hasHumidity() {
+		if err := b.dev.WriteReg(reg_ctrl_hum, []byte{osrs_h}); err != nil {
+			return err
+		}
+	}
+	if err := b.dev.WriteReg(reg_config, []byte{t_sb<<5 | filter<<2}); err != nil {
+		return err
+	}
+	if err := b.dev.WriteReg(reg_ctrl_meas, []byte{b.ctrlMeas | mode}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// measure triggers a forced measurement and waits until it is done.
+func (b *BME280) measure() error {
+	if err := b.dev.WriteReg(reg_ctrl_meas, []byte{b.ctrlMeas | mode_forced}); err != nil {
+		return err
+	}
+	// typical measurement time from the datasheet
+	time.Sleep(b.measureTime())
+	deadline := time.Now().Add(measure_timeout)
+	status := make([]byte, 1)
+	for {
+		if err := b.dev.ReadReg(reg_status, status); err != nil {
+			return err
+		}
+		if status[0]&status_measure == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("measurement not done after %v", b.measureTime()+measure_timeout)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func (b *BME280) measureTime() time.Duration {
+	us := 1000 + 2000*b.conf.OversamplingTemp +
+		2000*b.conf.OversamplingPress + 500 +
+		2000*b.conf.OversamplingHumid + 500
+	return time.Duration(us) * time.Microsecond
+}
+
 func (b *BME280) InitCalibrationData() error {
 	tmpdata24 := make([]byte, 24)
 	tmpdata1 := make([]byte, 1)
@@ -113,111 +337,145 @@ func (b *BME280) InitCalibrationData() error {
 	if err := b.dev.ReadReg(calib_addr1, tmpdata24); err != nil {
 		return err
 	}
-	if err := b.dev.ReadReg(calib_addr2, tmpdata1); err != nil {
-		return err
-	}
-	if err := b.dev.ReadReg(calib_addr3, tmpdata7); err != nil {
-		return err
+	if b.hasHumidity() {
+		if err := b.dev.ReadReg(calib_addr2, tmpdata1); err != nil {
+			return err
+		}
+		if err := b.dev.ReadReg(calib_addr3, tmpdata7); err != nil {
+			return err
+		}
 	}
-	calib_temp1 = (uint16(tmpdata24[1]) << 8) | uint16(tmpdata24[0])
-	calib_temp2 = (int16(tmpdata24[3]) << 8) | int16(tmpdata24[2])
-	calib_temp3 = (int16(tmpdata24[5]) << 8) | int16(tmpdata24[4])
-	calib_press1 = (uint16(tmpdata24[7]) << 8) | uint16(tmpdata24[6])
-	calib_press2 = (int16(tmpdata24[9]) << 8) | int16(tmpdata24[8])
-	calib_press3 = (int16(tmpdata24[11]) << 8) | int16(tmpdata24[10])
-	calib_press4 = (int16(tmpdata24[13]) << 8) | int16(tmpdata24[12])
-	calib_press5 = (int16(tmpdata24[15]) << 8) | int16(tmpdata24[14])
-	calib_press6 = (int16(tmpdata24[17]) << 8) | int16(tmpdata24[16])
-	calib_press7 = (int16(tmpdata24[19]) << 8) | int16(tmpdata24[18])
-	calib_press8 = (int16(tmpdata24[21]) << 8) | int16(tmpdata24[20])
-	calib_press9 = (int16(tmpdata24[23]) << 8) | int16(tmpdata24[22])
-	calib_humid1 = tmpdata1[0]
-	calib_humid2 = (int16(tmpdata7[1]) << 8) | int16(tmpdata7[0])
-	calib_humid3 = tmpdata7[2]
-	calib_humid4 = (int16(tmpdata7[3]) << 4) | (0x0F & int16(tmpdata7[4]))
-	calib_humid5 = (int16(tmpdata7[5]) << 4) | ((int16(tmpdata7[4]) >> 4) & 0x0F)
-	calib_humid6 = int8(tmpdata7[6])
+	b.calib.temp1 = (uint16(tmpdata24[1]) << 8) | uint16(tmpdata24[0])
+	b.calib.temp2 = (int16(tmpdata24[3]) << 8) | int16(tmpdata24[2])
+	b.calib.temp3 = (int16(tmpdata24[5]) << 8) | int16(tmpdata24[4])
+	b.calib.press1 = (uint16(tmpdata24[7]) << 8) | uint16(tmpdata24[6])
+	b.calib.press2 = (int16(tmpdata24[9]) << 8) | int16(tmpdata24[8])
+	b.calib.press3 = (int16(tmpdata24[11]) << 8) | int16(tmpdata24[10])
+	b.calib.press4 = (int16(tmpdata24[13]) << 8) | int16(tmpdata24[12])
+	b.calib.press5 = (int16(tmpdata24[15]) << 8) | int16(tmpdata24[14])
+	b.calib.press6 = (int16(tmpdata24[17]) << 8) | int16(tmpdata24[16])
+	b.calib.press7 = (int16(tmpdata24[19]) << 8) | int16(tmpdata24[18])
+	b.calib.press8 = (int16(tmpdata24[21]) << 8) | int16(tmpdata24[20])
+	b.calib.press9 = (int16(tmpdata24[23]) << 8) | int16(tmpdata24[22])
+	b.calib.humid1 = tmpdata1[0]
+	b.calib.humid2 = (int16(tmpdata7[1]) << 8) | int16(tmpdata7[0])
+	b.calib.humid3 = tmpdata7[2]
+	b.calib.humid4 = (int16(tmpdata7[3]) << 4) | (0x0F & int16(tmpdata7[4]))
+	b.calib.humid5 = (int16(tmpdata7[5]) << 4) | ((int16(tmpdata7[4]) >> 4) & 0x0F)
+	b.calib.humid6 = int8(tmpdata7[6])
 
 	return nil
 }
 
 func (b *BME280) Close() {
-	log.Println("Close sensor BME280")
+	if b.dev == nil {
+		return
+	}
+	log.Printf("Close sensor BME280 (%s)\n", b.name)
 	b.dev.Close()
+	b.dev = nil
 }
 
 func (b *BME280) GetSensorName() string {
 	return "BME280"
 }
 
+func (b *BME280) GetInstanceName() string {
+	return b.name
+}
+
 func (b *BME280) GetMetricsDescriptions() map[string]string {
-	return map[string]string{
-		conf.TemperatureMetricsName: "Temperature value in [°C] measured by BME280",
-		conf.HumidityMetricsName:    "Humidity value in [%] measured by BME280",
-		conf.PressureMetricsName:    "Pressure value in [hPa] measured by BME280",
+	desc := map[string]string{
+		b.conf.TemperatureMetricsName: "Temperature value in [°C] measured by BME280",
+		b.conf.PressureMetricsName:    "Pressure value in [hPa] measured by BME280",
+	}
+	if b.hasHumidity() {
+		desc[b.conf.HumidityMetricsName] = "Humidity value in [%] measured by BME280"
+	}
+	for name, help := range b.derivedDescriptions() {
+		desc[name] = help
 	}
+	return desc
 }
 
 func (b *BME280) calibrateTemp(rawValue int64) float64 {
-	var1 := (float64(rawValue)/16384.0 - float64(calib_temp1)/1024.0) * float64(calib_temp2)
-	var2 := (float64(rawValue)/131072.0 - float64(calib_temp1)/8192.0)
-	var2 = var2 * var2 * float64(calib_temp3)
-	t_fine = int(var1 + var2)
+	var1 := (float64(rawValue)/16384.0 - float64(b.calib.temp1)/1024.0) * float64(b.calib.temp2)
+	var2 := (float64(rawValue)/131072.0 - float64(b.calib.temp1)/8192.0)
+	var2 = var2 * var2 * float64(b.calib.temp3)
+	b.calib.t_fine = int(var1 + var2)
 	temp := (var1 + var2) / 5120.0
 
 	return math.Min(85.0, math.Max(-40.0, temp))
 }
 
 func (b *BME280) calibrateHumid(rawValue int64) float64 {
-	var1 := float64(t_fine) - 76800.0
-	var2 := float64(calib_humid4)*64.0 + (float64(calib_humid5)/16384.0)*var1
+	var1 := float64(b.calib.t_fine) - 76800.0
+	var2 := float64(b.calib.humid4)*64.0 + (float64(b.calib.humid5)/16384.0)*var1
 	var3 := float64(rawValue) - var2
-	var4 := float64(calib_humid2) / 65536.0
-	var5 := 1.0 + (float64(calib_humid3)/67108864.0)*var1
-	var6 := 1.0 + float64(calib_humid6)/67108864.0*var1*var5
+	var4 := float64(b.calib.humid2) / 65536.0
+	var5 := 1.0 + (float64(b.calib.humid3)/67108864.0)*var1
+	var6 := 1.0 + float64(b.calib.humid6)/67108864.0*var1*var5
 	var6 = var3 * var4 * (var5 * var6)
-	humid := var6 * (1.0 - float64(calib_humid1)*var6/524288.0)
+	humid := var6 * (1.0 - float64(b.calib.humid1)*var6/524288.0)
 
 	return math.Min(100.0, math.Max(0.0, humid))
 }
 
 func (b *BME280) calibratePress(rawValue int64) float64 {
-	var1 := float64(t_fine)/2.0 - 64000.0
-	var2 := var1 * var1 * float64(calib_press6) / 32768.0
-	var2 = var2 + var1*float64(calib_press5)*2.0
-	var2 = var2/4.0 + float64(calib_press4)*65536.0
-	var3 := float64(calib_press3) * var1 * var1 / 524288.0
-	var1 = (var3 + float64(calib_press2)*var1) / 524288.0
-	var1 = (1.0 + var1/32768.0) * float64(calib_press1)
+	var1 := float64(b.calib.t_fine)/2.0 - 64000.0
+	var2 := var1 * var1 * float64(b.calib.press6) / 32768.0
+	var2 = var2 + var1*float64(b.calib.press5)*2.0
+	var2 = var2/4.0 + float64(b.calib.press4)*65536.0
+	var3 := float64(b.calib.press3) * var1 * var1 / 524288.0
+	var1 = (var3 + float64(b.calib.press2)*var1) / 524288.0
+	var1 = (1.0 + var1/32768.0) * float64(b.calib.press1)
 	var pressure float64 = 30000.0 // min
 	if var1 > 0.0 {
 		pressure = 1048576.0 - float64(rawValue)
 		pressure = (pressure - var2/4096.0) * 6250.0 / var1
-		var1 = float64(calib_press9) * pressure * pressure / 2147483648.0
-		var2 = pressure * float64(calib_press8) / 32768.0
-		pressure = pressure + (var1+var2+float64(calib_press7))/16.0
+		var1 = float64(b.calib.press9) * pressure * pressure / 2147483648.0
+		var2 = pressure * float64(b.calib.press8) / 32768.0
+		pressure = pressure + (var1+var2+float64(b.calib.press7))/16.0
 	}
 
 	return math.Min(110000.0, math.Max(30000.0, pressure))
 }
 
-func (b *BME280) Update() map[string]float64 {
+func (b *BME280) Update() (map[string]float64, error) {
+	bufTemp := make([]byte, 3)
+	bufHumid := make([]byte, 2)
+	bufPress := make([]byte, 3)
+
+	if b.conf.Mode == "forced" {
+		if err := b.measure(); err != nil {
+			return b.data, err
+		}
+	}
+
 	// Temperature
-	b.dev.ReadReg(temp_msb, bufTemp)
+	if err := b.dev.ReadReg(temp_msb, bufTemp); err != nil {
+		return b.data, err
+	}
 	rawTempValue := int64(bufTemp[0])<<12 | int64(bufTemp[1])<<4 | int64(bufTemp[2])>>4
-	b.data[conf.TemperatureMetricsName] = b.calibrateTemp(rawTempValue)
+	b.data[b.conf.TemperatureMetricsName] = b.calibrateTemp(rawTempValue)
 
 	// Humidity
-	b.dev.ReadReg(hum_msb, bufHumid)
-	rawHumidValue := int64(bufHumid[0])<<8 | int64(bufHumid[1])
-	b.data[conf.HumidityMetricsName] = b.calibrateHumid(rawHumidValue)
+	if b.hasHumidity() {
+		if err := b.dev.ReadReg(hum_msb, bufHumid); err != nil {
+			return b.data, err
+		}
+		rawHumidValue := int64(bufHumid[0])<<8 | int64(bufHumid[1])
+		b.data[b.conf.HumidityMetricsName] = b.calibrateHumid(rawHumidValue)
+	}
 
 	// Pressure
-	b.dev.ReadReg(press_msb, bufPress)
+	if err := b.dev.ReadReg(press_msb, bufPress); err != nil {
+		return b.data, err
+	}
 	rawPressValue := int64(bufPress[0])<<12 | int64(bufPress[1])<<4 | int64(bufPress[2])>>4
-	b.data[conf.PressureMetricsName] = b.calibratePress(rawPressValue) / 100.0 // Convert [Pa] to [hPa]
+	b.data[b.conf.PressureMetricsName] = b.calibratePress(rawPressValue) / 100.0 // Convert [Pa] to [hPa]
 
-	return b.data
+	return b.data, nil
 }
 
 func (b *BME280) GetConsoleHeader() string {
@@ -226,6 +484,6 @@ func (b *BME280) GetConsoleHeader() string {
 
 func (b *BME280) GetConsoleData() string {
 	msg := fmt.Sprintf(" %15.2f | %11.2f | %13.2f ",
-		b.data[conf.TemperatureMetricsName], b.data[conf.HumidityMetricsName], b.data[conf.PressureMetricsName])
+		b.data[b.conf.TemperatureMetricsName], b.data[b.conf.HumidityMetricsName], b.data[b.conf.PressureMetricsName])
 	return msg
 }
@@ -0,0 +1,333 @@
+package bme280
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"sensor-exporter/bus/i2c"
+	"sensor-exporter/config"
+	"sensor-exporter/sensor"
+)
+
+// Compensation parameters and readings of the example in section 8.2 of the
+// BMP280 datasheet, which the BME280 shares for temperature and pressure.
+// The humidity parameters are those of a BME280 in the field.
+var (
+	ref_calib = calibration{
+		temp1: 27504, temp2: 26435, temp3: -1000,
+		press1: 36477, press2: -10685, press3: 3024, press4: 2855, press5: 140,
+		press6: -7, press7: 15500, press8: -14600, press9: 6000,
+		humid1: 75, humid2: 362, humid3: 0, humid4: 313, humid5: 50, humid6: 30,
+	}
+	ref_adc_t = int64(519888)
+	ref_adc_p = int64(415148)
+)
+
+// calibRegisters encodes calib in the register layout of the chip.
+func calibRegisters(calib calibration) (block1 []byte, h1 byte, block3 []byte) {
+	le := func(v uint16) []byte { return []byte{byte(v), byte(v >> 8)} }
+	for _, v := range []uint16{
+		calib.temp1, uint16(calib.temp2), uint16(calib.temp3),
+		calib.press1, uint16(calib.press2), uint16(calib.press3), uint16(calib.press4),
+		uint16(calib.press5), uint16(calib.press6), uint16(calib.press7),
+		uint16(calib.press8), uint16(calib.press9),
+	} {
+		block1 = append(block1, le(v)...)
+	}
+	block3 = append(le(uint16(calib.humid2)), calib.humid3,
+		byte(calib.humid4>>4), byte(calib.humid4&0x0F)|byte(calib.humid5&0x0F)<<4,
+		byte(calib.humid5>>4), byte(calib.humid6))
+	return block1, calib.humid1, block3
+}
+
+// raw20 encodes a 20 bit reading in the msb, lsb and xlsb registers.
+func raw20(v int64) []byte {
+	return []byte{byte(v >> 12), byte(v >> 4), byte(v&0x0F) << 4}
+}
+
+// The integer compensation formulas of section 4.2.3 of the BME280
+// datasheet, which the floating point ones of the driver must agree with.
+func refTemp(c calibration, adc int64) (int64, int64) {
+	t1, t2, t3 := int64(c.temp1), int64(c.temp2), int64(c.temp3)
+	var1 := (((adc >> 3) - (t1 << 1)) * t2) >> 11
+	var2 := (((((adc >> 4) - t1) * ((adc >> 4) - t1)) >> 12) * t3) >> 14
+	fine := var1 + var2
+	return fine, (fine*5 + 128) >> 8 // [0.01 °C]
+}
+
+func refPress(c calibration, fine, adc int64) int64 {
+	var1 := fine - 128000
+	var2 := var1 * var1 * int64(c.press6)
+	var2 = var2 + ((var1 * int64(c.press5)) << 17)
+	var2 = var2 + (int64(c.press4) << 35)
+	var1 = ((var1 * var1 * int64(c.press3)) >> 8) + ((var1 * int64(c.press2)) << 12)
+	var1 = (((int64(1) << 47) + var1) * int64(c.press1)) >> 33
+	if var1 == 0 {
+		return 0
+	}
+	p := 1048576 - adc
+	p = (((p << 31) - var2) * 3125) / var1
+	var1 = (int64(c.press9) * (p >> 13) * (p >> 13)) >> 25
+	var2 = (int64(c.press8) * p) >> 19
+	return ((p + var1 + var2) >> 8) + (int64(c.press7) << 4) // [Pa/256]
+}
+
+func refHumid(c calibration, fine, adc int64) int64 {
+	x := fine - 76800
+	x = (((adc << 14) - (int64(c.humid4) << 20) - (int64(c.humid5) * x) + 16384) >> 15) *
+		(((((((x*int64(c.humid6))>>10)*(((x*int64(c.humid3))>>11)+32768))>>10)+2097152)*int64(c.humid2) + 8192) >> 14)
+	x = x - (((((x >> 15) * (x >> 15)) >> 7) * int64(c.humid1)) >> 4)
+	if x < 0 {
+		x = 0
+	}
+	if x > 419430400 {
+		x = 419430400
+	}
+	return x >> 12 // [%RH/1024]
+}
+
+func TestCompensationDatasheetExample(t *testing.T) {
+	b := &BME280{calib: ref_calib}
+	temp := b.calibrateTemp(ref_adc_t)
+	if math.Abs(temp-25.08) > 0.005 {
+		t.Errorf("temperature = %.4f °C, want 25.08", temp)
+	}
+	if b.calib.t_fine != 128422 {
+		t.Errorf("t_fine = %d, want 128422", b.calib.t_fine)
+	}
+	press := b.calibratePress(ref_adc_p)
+	if math.Abs(press-100653.27) > 0.05 {
+		t.Errorf("pressure = %.4f Pa, want 100653.27", press)
+	}
+}
+
+func TestCompensationMatchesIntegerFormulas(t *testing.T) {
+	for _, tc := range []struct{ adcT, adcP, adcH int64 }{
+		{ref_adc_t, ref_adc_p, 30000},
+		{450000, 390000, 24000},
+		{600000, 470000, 34000},
+		{500000, 440000, 28000},
+	} {
+		b := &BME280{calib: ref_calib}
+		temp := b.calibrateTemp(tc.adcT)
+		fine, want := refTemp(ref_calib, tc.adcT)
+		if math.Abs(temp-float64(want)/100) > 0.01 {
+			t.Errorf("adc_T %d: temperature = %.3f °C, want %.2f", tc.adcT, temp, float64(want)/100)
+		}
+		press := b.calibratePress(tc.adcP)
+		if wantP := float64(refPress(ref_calib, fine, tc.adcP)) / 256; math.Abs(press-wantP) > 1 {
+			t.Errorf("adc_P %d: pressure = %.2f Pa, want %.2f", tc.adcP, press, wantP)
+		}
+		humid := b.calibrateHumid(tc.adcH)
+		if wantH := float64(refHumid(ref_calib, fine, tc.adcH)) / 1024; math.Abs(humid-wantH) > 0.1 {
+			t.Errorf("adc_H %d: humidity = %.3f %%RH, want %.3f", tc.adcH, humid, wantH)
+		}
+	}
+}
+
+func simBME280(t *testing.T, chipID byte, conf config.Bme280) (*BME280, *i2c.SimDevice) {
+	t.Helper()
+	bus := i2c.NewSimBus()
+	dev := bus.AddDevice(0x76)
+	dev.Set(reg_chip_id, chipID)
+	block1, h1, block3 := calibRegisters(ref_calib)
+	dev.Set(calib_addr1, block1...)
+	dev.Set(calib_addr2, h1)
+	dev.Set(calib_addr3, block3...)
+	dev.Set(press_msb, raw20(ref_adc_p)...)
+	dev.Set(temp_msb, raw20(ref_adc_t)...)
+	dev.Set(hum_msb, 0x75, 0x30) // 30000
+
+	conf.I2cAddress = 0x76
+	conf.TemperatureMetricsName = "temperature"
+	conf.HumidityMetricsName = "humidity"
+	conf.PressureMetricsName = "pressure"
+	if conf.Mode == "" {
+		conf.Mode = "normal"
+	}
+	conf.OversamplingTemp, conf.OversamplingHumid, conf.OversamplingPress = 1, 1, 1
+	conf.Filter = 0
+	if conf.Standby == 0 {
+		conf.Standby = time.Second
+	}
+	config.Set(config.Config{Bme280: map[string]config.Bme280{"bme280": conf}})
+	t.Cleanup(func() { config.Set(config.Config{}) })
+
+	b := New("bme280")
+	b.Bus = bus
+	if err := b.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return b, dev
+}
+
+func TestUpdateThroughSimBus(t *testing.T) {
+	b, dev := simBME280(t, 0x60, config.Bme280{})
+	if b.calib != ref_calib {
+		t.Fatalf("calibration read from the registers = %+v, want %+v", b.calib, ref_calib)
+	}
+	data, err := b.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fine, _ := refTemp(ref_calib, ref_adc_t)
+	if v := data["temperature"]; math.Abs(v-25.08) > 0.005 {
+		t.Errorf("temperature = %.4f, want 25.08", v)
+	}
+	if v := data["pressure"]; math.Abs(v-1006.5327) > 0.0005 {
+		t.Errorf("pressure = %.4f hPa, want 1006.5327", v)
+	}
+	if v, want := data["humidity"], float64(refHumid(ref_calib, fine, 30000))/1024; math.Abs(v-want) > 0.1 {
+		t.Errorf("humidity = %.3f, want %.3f", v, want)
+	}
+
+	// reset, then ctrl_meas in sleep mode, ctrl_hum, config and ctrl_meas
+	want := []i2c.SimWrite{
+		{Reg: reg_reset, Data: []byte{reset_word}},
+		{Reg: reg_ctrl_meas, Data: []byte{1<<5 | 1<<2 | mode_sleep}},
+		{Reg: reg_ctrl_hum, Data: []byte{1}},
+		{Reg: reg_config, Data: []byte{5 << 5}},
+		{Reg: reg_ctrl_meas, Data: []byte{1<<5 | 1<<2 | mode_normal}},
+	}
+	writes := dev.Writes()
+	if len(writes) != len(want) {
+		t.Fatalf("writes = %v, want %v", writes, want)
+	}
+	for i := range want {
+		if writes[i].Reg != want[i].Reg || string(writes[i].Data) != string(want[i].Data) {
+			t.Errorf("write %d = %v, want %v", i, writes[i], want[i])
+		}
+	}
+}
+
+func TestBMP280HasNoHumidity(t *testing.T) {
+	b, dev := simBME280(t, 0x58, config.Bme280{})
+	if chip, id := b.Chip(); chip != "BMP280" || id != "0x58" {
+		t.Errorf("Chip() = %s, %s", chip, id)
+	}
+	data, err := b.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["humidity"]; ok {
+		t.Errorf("BMP280 reports a humidity")
+	}
+	for _, w := range dev.Writes() {
+		if w.Reg == reg_ctrl_hum {
+			t.Errorf("ctrl_hum written on a BMP280")
+		}
+	}
+}
+
+func TestForcedModeWaitsForMeasurement(t *testing.T) {
+	b, dev := simBME280(t, 0x60, config.Bme280{Mode: "forced"})
+	polls := 0
+	dev.Set(reg_status, status_measure)
+	dev.OnRead(reg_status, func(d *i2c.SimDevice) {
+		if polls++; polls == 3 {
+			d.Set(reg_status, 0)
+		}
+	})
+	if _, err := b.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if polls < 3 {
+		t.Errorf("status polled %d times, want 3", polls)
+	}
+	writes := dev.Writes()
+	if last := writes[len(writes)-1]; last.Reg != reg_ctrl_meas || last.Data[0]&3 != mode_forced {
+		t.Errorf("last write = %v, want ctrl_meas in forced mode", last)
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	bus := i2c.NewSimBus()
+	dev := bus.AddDevice(0x76)
+	dev.Set(reg_chip_id, 0x61)
+	config.Set(config.Config{Bme280: map[string]config.Bme280{"bme280": {I2cAddress: 0x76}}})
+	defer config.Set(config.Config{})
+	b := New("bme280")
+	b.Bus = bus
+	if err := b.Init(); err == nil {
+		t.Errorf("Init accepted chip id 0x61")
+	}
+
+	fault := errors.New("nack")
+	b, dev = simBME280(t, 0x60, config.Bme280{})
+	dev.FailRead(temp_msb, fault)
+	if _, err := b.Update(); err != fault {
+		t.Errorf("Update = %v, want %v", err, fault)
+	}
+	b.Close()
+	dev.FailRead(calib_addr1, fault)
+	if err := b.Init(); err != fault {
+		t.Errorf("Init = %v, want %v", err, fault)
+	}
+}
+
+func TestStandbyByChip(t *testing.T) {
+	for _, tc := range []struct {
+		chip    byte
+		standby time.Duration
+		t_sb    byte
+		ok      bool
+	}{
+		{0x60, 10 * time.Millisecond, 6, true},
+		{0x60, 20 * time.Millisecond, 7, true},
+		{0x60, 2 * time.Second, 0, false},
+		{0x58, 2 * time.Second, 6, true},
+		{0x56, 4 * time.Second, 7, true},
+		{0x57, 10 * time.Millisecond, 0, false},
+		{0x58, 500 * time.Millisecond, 4, true},
+	} {
+		bus := i2c.NewSimBus()
+		dev := bus.AddDevice(0x76)
+		dev.Set(reg_chip_id, tc.chip)
+		config.Set(config.Config{Bme280: map[string]config.Bme280{"bme280": {
+			I2cAddress: 0x76, Mode: "normal", Standby: tc.standby,
+			OversamplingTemp: 1, OversamplingHumid: 1, OversamplingPress: 1,
+		}}})
+		b := New("bme280")
+		b.Bus = bus
+		err := b.Init()
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("chip 0x%02x accepted standby %v", tc.chip, tc.standby)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("chip 0x%02x, standby %v: %v", tc.chip, tc.standby, err)
+			continue
+		}
+		if got := dev.Get(reg_config, 1)[0] >> 5; got != tc.t_sb {
+			t.Errorf("chip 0x%02x, standby %v: t_sb = %d, want %d", tc.chip, tc.standby, got, tc.t_sb)
+		}
+	}
+	config.Set(config.Config{})
+}
+
+func TestDeriveFromCorrectedReadings(t *testing.T) {
+	b, _ := simBME280(t, 0x60, config.Bme280{DewPointMetricsName: "dew_point"})
+	data, err := b.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["dew_point"]; ok {
+		t.Errorf("Update derived the dew point from the raw readings")
+	}
+
+	// as corrected by the pipeline, e.g. with offset_temperature = -5.08
+	corrected := map[string]float64{"temperature": 20, "humidity": 50, "pressure": 1000}
+	now := time.Now()
+	b.Derive(corrected, now)
+	if v, want := corrected["dew_point"], dewPoint(20, 50); v != want {
+		t.Errorf("dew point = %v, want %v", v, want)
+	}
+	env, ok := sensor.GetEnvironment("bme280")
+	if !ok || env.Temperature != 20 || env.Humidity != 50 || !env.Time.Equal(now) {
+		t.Errorf("environment = %+v, want the corrected readings", env)
+	}
+}
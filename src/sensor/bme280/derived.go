@@ -0,0 +1,133 @@
+package bme280
+
+import (
+	"math"
+	"time"
+
+	"sensor-exporter/sensor"
+)
+
+var (
+	// Magnus formula coefficients over water (Sonntag 1990)
+	magnus_a = 6.112  // [hPa]
+	magnus_b = 17.62  // []
+	magnus_c = 243.12 // [°C]
+
+	// Barometric formula of the international standard atmosphere
+	isa_height   = 44330.0 // [m]
+	isa_exponent = 5.255
+)
+
+// saturationPressure returns the saturation vapour pressure in [hPa].
+func saturationPressure(temp float64) float64 {
+	return magnus_a * math.Exp(magnus_b*temp/(magnus_c+temp))
+}
+
+// dewPoint returns the dew point in [°C].
+func dewPoint(temp, humid float64) float64 {
+	gamma := math.Log(math.Max(humid, 0.01)/100.0) + magnus_b*temp/(magnus_c+temp)
+	return magnus_c * gamma / (magnus_b - gamma)
+}
+
+// absoluteHumidity returns the water vapour density in [g/m³].
+func absoluteHumidity(temp, humid float64) float64 {
+	e := humid / 100.0 * saturationPressure(temp)
+	return 216.7 * e / (273.15 + temp)
+}
+
+// heatIndex returns the NOAA heat index in [°C].
+func heatIndex(temp, humid float64) float64 {
+	t := temp*9.0/5.0 + 32.0
+	hi := 0.5 * (t + 61.0 + (t-68.0)*1.2 + humid*0.094)
+	if (hi+t)/2.0 >= 80.0 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*humid -
+			0.22475541*t*humid - 0.00683783*t*t -
+			0.05481717*humid*humid + 0.00122874*t*t*humid +
+			0.00085282*t*humid*humid - 0.00000199*t*t*humid*humid
+		if humid < 13.0 && t >= 80.0 && t <= 112.0 {
+			hi -= (13.0 - humid) / 4.0 * math.Sqrt((17.0-math.Abs(t-95.0))/17.0)
+		} else if humid > 85.0 && t >= 80.0 && t <= 87.0 {
+			hi += (humid - 85.0) / 10.0 * (87.0 - t) / 5.0
+		}
+	}
+	return (hi - 32.0) * 5.0 / 9.0
+}
+
+// humidex returns the Canadian humidex.
+func humidex(temp, humid float64) float64 {
+	e := 6.11 * math.Exp(5417.7530*(1.0/273.16-1.0/(273.15+dewPoint(temp, humid))))
+	return temp + 0.5555*(e-10.0)
+}
+
+// vapourPressureDeficit returns the vapour pressure deficit in [kPa].
+func vapourPressureDeficit(temp, humid float64) float64 {
+	return (1.0 - humid/100.0) * saturationPressure(temp) / 10.0
+}
+
+// altitude returns the altitude in [m] at which the pressure is press [hPa],
+// given the pressure at sea level.
+func altitude(press, seaLevel float64) float64 {
+	return isa_height * (1.0 - math.Pow(press/seaLevel, 1.0/isa_exponent))
+}
+
+// seaLevelPressure returns the pressure in [hPa] at sea level, given the
+// pressure press [hPa] at the altitude [m] of the station.
+func seaLevelPressure(press, alt float64) float64 {
+	return press / math.Pow(1.0-alt/isa_height, isa_exponent)
+}
+
+// Derive computes the enabled derived metrics from the corrected readings,
+// and shares the corrected environment with sensors compensating with it.
+func (b *BME280) Derive(data map[string]float64, t time.Time) {
+	temp := data[b.conf.TemperatureMetricsName]
+	press := data[b.conf.PressureMetricsName]
+	if b.hasHumidity() {
+		humid := data[b.conf.HumidityMetricsName]
+		if b.conf.DewPointMetricsName != "" {
+			data[b.conf.DewPointMetricsName] = dewPoint(temp, humid)
+		}
+		if b.conf.AbsoluteHumidityMetricsName != "" {
+			data[b.conf.AbsoluteHumidityMetricsName] = absoluteHumidity(temp, humid)
+		}
+		if b.conf.HeatIndexMetricsName != "" {
+			data[b.conf.HeatIndexMetricsName] = heatIndex(temp, humid)
+		}
+		if b.conf.HumidexMetricsName != "" {
+			data[b.conf.HumidexMetricsName] = humidex(temp, humid)
+		}
+		if b.conf.VpdMetricsName != "" {
+			data[b.conf.VpdMetricsName] = vapourPressureDeficit(temp, humid)
+		}
+		sensor.SetEnvironment(b.name, sensor.Environment{
+			Temperature: temp,
+			Humidity:    humid,
+			Time:        t,
+		})
+	}
+	if b.conf.AltitudeMetricsName != "" {
+		data[b.conf.AltitudeMetricsName] = altitude(press, b.conf.SeaLevelPressure)
+	}
+	if b.conf.SeaLevelPressureMetricsName != "" {
+		data[b.conf.SeaLevelPressureMetricsName] = seaLevelPressure(press, b.conf.Altitude)
+	}
+}
+
+// derivedDescriptions returns the descriptions of the enabled derived metrics.
+func (b *BME280) derivedDescriptions() map[string]string {
+	desc := map[string]string{}
+	add := func(name, help string) {
+		if name != "" {
+			desc[name] = help
+		}
+	}
+	if b.hasHumidity() {
+		add(b.conf.DewPointMetricsName, "Dew point in [°C] derived from BME280")
+		add(b.conf.AbsoluteHumidityMetricsName, "Absolute humidity in [g/m³] derived from BME280")
+		add(b.conf.HeatIndexMetricsName, "Heat index in [°C] derived from BME280")
+		add(b.conf.HumidexMetricsName, "Humidex derived from BME280")
+		add(b.conf.VpdMetricsName, "Vapour pressure deficit in [kPa] derived from BME280")
+	}
+	add(b.conf.AltitudeMetricsName, "Altitude in [m] derived from the pressure measured by BME280 and sea_level_pressure")
+	add(b.conf.SeaLevelPressureMetricsName, "Pressure at sea level in [hPa] derived from the pressure measured by BME280 and altitude")
+	return desc
+}
@@ -0,0 +1,67 @@
+package ccs811
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// baselineState is the baseline persisted in the state directory.
+type baselineState struct {
+	Baseline uint16    `json:"baseline"`
+	SavedAt  time.Time `json:"saved_at"`
+	// FirstSeen is when the sensor was first run, to tell when the burn-in
+	// period is over.
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+func (c *CCS811) statePath() string {
+	if c.stateDir == "" {
+		return ""
+	}
+	return filepath.Join(c.stateDir, c.name+".baseline.json")
+}
+
+// loadState reads the persisted state. A missing file is not an error and
+// returns a new state.
+func (c *CCS811) loadState() (baselineState, error) {
+	state := baselineState{FirstSeen: time.Now()}
+	path := c.statePath()
+	if path == "" {
+		return state, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return baselineState{FirstSeen: time.Now()}, err
+	}
+	return state, nil
+}
+
+// saveState writes the state to a temporary file and renames it, so that a
+// crash never leaves a truncated file behind.
+func (c *CCS811) saveState(state baselineState) error {
+	path := c.statePath()
+	if path == "" {
+		return nil
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.stateDir, 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,149 @@
+package ccs811
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sensor-exporter/config"
+)
+
+// setStateDir sets the state_dir of the config set by setConfig.
+func setStateDir(t *testing.T, dir string) {
+	t.Helper()
+	c := config.GetConfig()
+	c.Default.StateDir = dir
+	config.Set(c)
+}
+
+func writeState(t *testing.T, dir string, state baselineState) {
+	t.Helper()
+	b, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ccs811.baseline.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readState(t *testing.T, dir string) baselineState {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, "ccs811.baseline.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state baselineState
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestBaselineRestore(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name     string
+		state    baselineState
+		restored bool
+	}{
+		{"restored", baselineState{Baseline: 0x1234, SavedAt: now.Add(-time.Hour), FirstSeen: now.Add(-100 * time.Hour)}, true},
+		{"burning in", baselineState{Baseline: 0x1234, SavedAt: now.Add(-time.Hour), FirstSeen: now.Add(-10 * time.Hour)}, false},
+		{"too old", baselineState{Baseline: 0x1234, SavedAt: now.Add(-200 * time.Hour), FirstSeen: now.Add(-300 * time.Hour)}, false},
+	} {
+		setConfig(t, config.Ccs811{BurnIn: 48 * time.Hour, BaselineMaxAge: 168 * time.Hour})
+		dir := t.TempDir()
+		setStateDir(t, dir)
+		writeState(t, dir, tc.state)
+		bus, dev := simCCS811()
+		dev.Set(baseline, 0xAB, 0xCD)
+		c := New("ccs811")
+		c.Bus = bus
+		if err := c.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the restored baseline is reported from Init, and written at the
+		// first baseline cycle
+		want := 0.0
+		if tc.restored {
+			want = 0x1234
+		}
+		if c.data["baseline"] != want {
+			t.Errorf("%s: baseline after Init = %v, want %v", tc.name, c.data["baseline"], want)
+		}
+		c.updateBaseline()
+		got := dev.Get(baseline, 2)
+		if tc.restored && !bytes.Equal(got, []byte{0x12, 0x34}) {
+			t.Errorf("%s: BASELINE = % x, want 12 34", tc.name, got)
+		}
+		if !tc.restored && !bytes.Equal(got, []byte{0xAB, 0xCD}) {
+			t.Errorf("%s: BASELINE = % x, want the sensor's ab cd", tc.name, got)
+		}
+	}
+}
+
+func TestBaselineSave(t *testing.T) {
+	setConfig(t, config.Ccs811{BurnIn: 48 * time.Hour, BaselineMaxAge: 168 * time.Hour})
+	dir := t.TempDir()
+	setStateDir(t, dir)
+	bus, dev := simCCS811()
+	dev.Set(baseline, 0xAB, 0xCD)
+	c := New("ccs811")
+	c.Bus = bus
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new sensor is remembered, but its baseline is not saved during the
+	// burn-in
+	firstSeen := readState(t, dir).FirstSeen
+	if time.Since(firstSeen) > time.Minute {
+		t.Fatalf("first seen %v, want now", firstSeen)
+	}
+	c.updateBaseline()
+	if c.data["baseline"] != 0xABCD {
+		t.Errorf("baseline = %v, want 0xabcd", c.data["baseline"])
+	}
+	if state := readState(t, dir); state.Baseline != 0 {
+		t.Errorf("baseline %d saved during the burn-in", state.Baseline)
+	}
+
+	// once it is over, the baseline of the sensor is saved
+	c.state.FirstSeen = time.Now().Add(-49 * time.Hour)
+	c.updateBaseline()
+	state := readState(t, dir)
+	if state.Baseline != 0xABCD || time.Since(state.SavedAt) > time.Minute || !state.FirstSeen.Equal(c.state.FirstSeen) {
+		t.Errorf("saved state = %+v", state)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ccs811.baseline.json.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestBaselineConfigured(t *testing.T) {
+	setConfig(t, config.Ccs811{Baseline: 0x4321})
+	dir := t.TempDir()
+	setStateDir(t, dir)
+	bus, dev := simCCS811()
+	c := New("ccs811")
+	c.Bus = bus
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if c.data["baseline"] != 0x4321 {
+		t.Errorf("baseline after Init = %v, want 0x4321", c.data["baseline"])
+	}
+	c.updateBaseline()
+	if got := dev.Get(baseline, 2); !bytes.Equal(got, []byte{0x43, 0x21}) {
+		t.Errorf("BASELINE = % x, want 43 21", got)
+	}
+	// a configured baseline is not persisted
+	if _, err := os.Stat(filepath.Join(dir, "ccs811.baseline.json")); !os.IsNotExist(err) {
+		t.Errorf("state file written: %v", err)
+	}
+}
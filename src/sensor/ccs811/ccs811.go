@@ -5,21 +5,19 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"sensor-exporter/bus/i2c"
 	"sensor-exporter/config"
+	"sensor-exporter/sensor"
 	"time"
-
-	"golang.org/x/exp/io/i2c"
 )
 
 var (
-	conf config.Ccs811
-
 	// Addresses
 	status          = byte(0x00)
 	meas_mode       = byte(0x01)
 	alg_result_data = byte(0x02)
 	//raw_data        = byte(0x03)
-	//env_data        = byte(0x05)
+	env_data = byte(0x05)
 	//ntc             = byte(0x06)
 	//thresholds      = byte(0x10)
 	baseline = byte(0x11)
@@ -31,41 +29,105 @@ var (
 	app_start = byte(0xF4)
 	//sw_reset        = byte(0xFF)
 
-	// Config values
-	mode = byte(0x01) // 1 sec drive mode
+	// Drive modes
+	mode_1sec  = byte(0x01) // constant power, measurement every second
+	mode_10sec = byte(0x02) // pulse heating, measurement every 10 seconds
+	mode_60sec = byte(0x03) // low power pulse heating, measurement every 60 seconds
+
+	// Interval to write the baseline to the sensor
+	baseline_interval = 20 * time.Minute
+
+	// Time to wait for the first measurement after app start
+	start_timeout = 2 * time.Minute
 
+	// Environment assumed by the sensor without compensation
+	default_temperature = 25.0 // [°C]
+	default_humidity    = 50.0 // [%RH]
 )
 
+func init() {
+	sensor.Register(sensor.Driver{
+		Name:        "ccs811",
+		Description: "ams CCS811 eCO2 and TVOC sensor on I2C, drive mode follows poll_interval (1s, 10s, 60s)",
+		ConfigKeys: []sensor.ConfigKey{
+			{Name: "i2c_device", Default: "/dev/i2c-1", Help: "I2C bus device"},
+			{Name: "i2c_address", Default: "0x5a", Help: "I2C address of the sensor (0x5a or 0x5b)", Kind: sensor.KindInt, Check: sensor.IntOneOf(0x5a, 0x5b)},
+			{Name: "metrics_name_eco2", Default: "eco2", Help: "metrics name of the eCO2 in [ppm]"},
+			{Name: "metrics_name_evoc", Default: "tvoc", Help: "metrics name of the TVOC in [ppb]"},
+			{Name: "metrics_name_baseline", Default: "ccs811_baseline", Help: "metrics name of the baseline of the sensor"},
+			{Name: "baseline", Default: "0", Help: "baseline written to the sensor every 20 minutes, 0 to persist the sensor's baseline in state_dir", Kind: sensor.KindInt, Check: sensor.IntRange(0, 0xFFFF)},
+			{Name: "burn_in", Default: "48h", Help: "run time of a new sensor before its baseline is persisted", Kind: sensor.KindDuration},
+			{Name: "baseline_max_age", Default: "168h", Help: "age after which a persisted baseline is not restored", Kind: sensor.KindDuration, Check: sensor.Positive},
+			{Name: "env_source", Default: "", Help: "sensor section (e.g. bme280) whose temperature and humidity compensate the readings", Kind: sensor.KindSensor},
+			{Name: "env_max_age", Default: "5m", Help: "age after which the env_source reading is no longer used", Kind: sensor.KindDuration, Check: sensor.Positive},
+		},
+		New: func(name string) sensor.Sensor { return New(name) },
+	})
+}
+
 type CCS811 struct {
-	data          map[string]float64
-	dev           *i2c.Device
-	baseline      uint16
-	baselineCount int
-	wakeupFlag    bool
+	name           string
+	conf           config.Ccs811
+	data           map[string]float64
+	dev            i2c.Device
+	baseline       uint16
+	baselineCount  int
+	baselineCycles int
+	mode           byte
+	stateDir       string
+	state          baselineState
+	restore        bool      // write the restored baseline at the next baseline cycle
+	envTime        time.Time // time of the environment last written
+	envStale       bool
+
+	// Bus is used to open the device. If nil, the bus named by i2c_device is used.
+	Bus i2c.Bus
+}
+
+// New returns a driver for the sensor configured in section name.
+func New(name string) *CCS811 {
+	return &CCS811{name: name, conf: config.GetConfig().Ccs811[name]}
 }
 
 func (c *CCS811) Init() error {
 	// init vars
-	conf = config.GetConfig().Ccs811
-	log.Println("Open sensor CCS811")
+	c.conf = config.GetConfig().Ccs811[c.name]
+	log.Printf("Open sensor CCS811 (%s)\n", c.name)
 
 	c.data = map[string]float64{
-		conf.Co2MetricsName: 0.0,
-		conf.VocMetricsName: 0.0,
+		c.conf.Co2MetricsName:      0.0,
+		c.conf.VocMetricsName:      0.0,
+		c.conf.BaselineMetricsName: 0.0,
 	}
 
-	dev, err := i2c.Open(&i2c.Devfs{Dev: conf.I2cDevice}, conf.I2cAddress)
+	bus := c.Bus
+	if bus == nil {
+		bus = i2c.Lookup(c.conf.I2cDevice)
+	}
+	dev, err := bus.Open(c.conf.I2cAddress)
 	if err != nil {
 		return err
 	}
 	c.dev = dev
 
+	// derive the drive mode from the poll interval
+	interval := config.GetConfig().Sensors[c.name].PollInterval
+	c.mode = driveMode(interval)
 	c.baselineCount = 0
-	c.baseline = uint16(conf.Baseline)
-	c.wakeupFlag = false
+	c.baselineCycles = 1
+	if interval > 0 && interval < baseline_interval {
+		c.baselineCycles = int(baseline_interval / interval)
+	}
+	c.baseline = uint16(c.conf.Baseline)
+	c.stateDir = config.GetConfig().Default.StateDir
+	c.restore = false
 	if c.baseline == 0 {
-		c.wakeupFlag = true
+		c.loadBaseline()
 	}
+	// the configured or restored baseline until it is written
+	c.data[c.conf.BaselineMetricsName] = float64(c.baseline)
+	c.envTime = time.Time{}
+	c.envStale = false
 
 	// validate ccs811
 	//// hardware id
@@ -104,18 +166,74 @@ func (c *CCS811) Init() error {
 	}
 
 	// waiting for start sensor
+	deadline := time.Now().Add(start_timeout)
 	for {
-		c.Update()
+		if _, err := c.Update(); err != nil {
+			return err
+		}
 		time.Sleep(1 * time.Second)
-		if c.data[conf.Co2MetricsName] > 0 {
+		if c.data[c.conf.Co2MetricsName] > 0 {
 			// min co2 value is 400 if the sensor is running
 			break
 		}
+		if time.Now().After(deadline) {
+			return errors.New("no data from the sensor after app start")
+		}
 	}
 
 	return nil
 }
 
+// loadBaseline restores the persisted baseline unless the sensor is still
+// burning in or the baseline is too old to match the sensor anymore.
+func (c *CCS811) loadBaseline() {
+	state, err := c.loadState()
+	if err != nil {
+		log.Printf("%s: cannot load the baseline: %v\n", c.name, err)
+	}
+	c.state = state
+	switch {
+	case state.Baseline == 0:
+		// remember when the sensor was first seen to track its burn-in
+		if err := c.saveState(state); err != nil {
+			log.Printf("%s: cannot save the baseline: %v\n", c.name, err)
+		}
+	case time.Since(state.FirstSeen) < c.conf.BurnIn:
+		log.Printf("%s: sensor is burning in, baseline not restored\n", c.name)
+	case time.Since(state.SavedAt) > c.conf.BaselineMaxAge:
+		log.Printf("%s: baseline saved at %v is older than %v, not restored\n", c.name, state.SavedAt.Format(time.RFC3339), c.conf.BaselineMaxAge)
+	default:
+		log.Printf("%s: restore baseline %d saved at %v\n", c.name, state.Baseline, state.SavedAt.Format(time.RFC3339))
+		c.baseline = state.Baseline
+		c.restore = true
+	}
+}
+
+// updateBaseline writes the configured or restored baseline, or reads the
+// baseline of the sensor and persists it once the burn-in is over. The
+// datasheet asks to wait 20 minutes after start for either.
+func (c *CCS811) updateBaseline() {
+	if c.conf.Baseline != 0 || c.restore {
+		c.setBaseline()
+		c.restore = false
+		c.data[c.conf.BaselineMetricsName] = float64(c.baseline)
+		return
+	}
+	c.baseline = c.getBaseline()
+	if c.baseline == 0 {
+		return
+	}
+	c.data[c.conf.BaselineMetricsName] = float64(c.baseline)
+	if time.Since(c.state.FirstSeen) < c.conf.BurnIn {
+		return
+	}
+	c.state.Baseline = c.baseline
+	c.state.SavedAt = time.Now()
+	if err := c.saveState(c.state); err != nil {
+		log.Printf("%s: cannot save the baseline: %v\n", c.name, err)
+	}
+}
+
 func (c *CCS811) getBaseline() uint16 {
 	val_baseline := make([]byte, 2)
 	if err := c.dev.ReadReg(baseline, val_baseline); err != nil {
@@ -136,6 +254,52 @@ func (c *CCS811) setBaseline() uint16 {
 	return c.getBaseline()
 }
 
+// compensate writes the temperature and humidity of env_source to ENV_DATA,
+// so the algorithm does not assume the default 25 °C and 50 %RH. Once the
+// environment is older than env_max_age, the defaults are written back
+// rather than leaving the last environment in place.
+func (c *CCS811) compensate() error {
+	if c.conf.EnvSource == "" {
+		return nil
+	}
+	env, ok := sensor.GetEnvironment(c.conf.EnvSource)
+	if !ok {
+		return nil
+	}
+	if time.Since(env.Time) > c.conf.EnvMaxAge {
+		if c.envStale {
+			return nil
+		}
+		if err := c.dev.WriteReg(env_data, envData(default_temperature, default_humidity)); err != nil {
+			return fmt.Errorf("ccs811 write env data error: %v", err)
+		}
+		log.Printf("%s: environment from %s is older than %v, back to %v °C and %v %%RH\n", c.name, c.conf.EnvSource, c.conf.EnvMaxAge, default_temperature, default_humidity)
+		c.envStale = true
+		return nil
+	}
+	if !env.Time.After(c.envTime) {
+		// nothing new to write
+		return nil
+	}
+	if err := c.dev.WriteReg(env_data, envData(env.Temperature, env.Humidity)); err != nil {
+		return fmt.Errorf("ccs811 write env data error: %v", err)
+	}
+	if c.envStale {
+		log.Printf("%s: environment from %s is up to date again\n", c.name, c.conf.EnvSource)
+		c.envStale = false
+	}
+	c.envTime = env.Time
+	return nil
+}
+
+// envData encodes temperature [°C] and humidity [%RH] in the ENV_DATA format:
+// humidity and temperature + 25 °C as unsigned 1/512 fixed-point values.
+func envData(temperature, humidity float64) []byte {
+	h := uint16(math.Round(math.Min(100.0, math.Max(0.0, humidity)) * 512))
+	t := uint16(math.Round(math.Min(100.0, math.Max(0.0, temperature+25.0)) * 512))
+	return []byte{byte(h >> 8), byte(h), byte(t >> 8), byte(t)}
+}
+
 func (c *CCS811) checkError() error {
 	errorMsg := "error: "
 	val_hw_status := make([]byte, 1)
@@ -185,7 +349,7 @@ func (c *CCS811) setDriveMode() error {
 		return err
 	}
 	setting[0] = setting[0] & (^(byte(7) << 4))
-	setting[0] = setting[0] | (mode << 4)
+	setting[0] = setting[0] | (c.mode << 4)
 	if err := c.dev.WriteReg(meas_mode, setting); err != nil {
 		return err
 	}
@@ -193,48 +357,66 @@ func (c *CCS811) setDriveMode() error {
 	return nil
 }
 
+// driveMode returns the slowest drive mode that still produces a new
+// measurement for every poll.
+func driveMode(interval time.Duration) byte {
+	if interval >= 60*time.Second {
+		return mode_60sec
+	}
+	if interval >= 10*time.Second {
+		return mode_10sec
+	}
+	return mode_1sec
+}
+
 func (c *CCS811) Close() {
-	log.Println("Close sensor CCS811")
+	if c.dev == nil {
+		return
+	}
+	log.Printf("Close sensor CCS811 (%s)\n", c.name)
 	c.dev.Close()
+	c.dev = nil
 }
 
 func (c *CCS811) GetSensorName() string {
 	return "CCS811"
 }
 
+func (c *CCS811) GetInstanceName() string {
+	return c.name
+}
+
 func (c *CCS811) GetMetricsDescriptions() map[string]string {
 	return map[string]string{
-		conf.Co2MetricsName: "CO2 value in [ppm] measured by CCS811",
-		conf.VocMetricsName: "VOC value in [ppb] measured by CCS811",
+		c.conf.Co2MetricsName:      "CO2 value in [ppm] measured by CCS811",
+		c.conf.VocMetricsName:      "VOC value in [ppb] measured by CCS811",
+		c.conf.BaselineMetricsName: "Baseline of CCS811",
 	}
 }
 
-func (c *CCS811) Update() map[string]float64 {
+func (c *CCS811) Update() (map[string]float64, error) {
 	c.baselineCount = c.baselineCount + 1
-	if c.baselineCount%1200 == 0 {
+	if c.baselineCount%c.baselineCycles == 0 {
 		c.baselineCount = 0
-		if c.wakeupFlag {
-			c.baseline = c.getBaseline()
-			c.wakeupFlag = false
-		}
-		c.setBaseline()
+		c.updateBaseline()
+	}
+	if err := c.compensate(); err != nil {
+		return c.data, err
 	}
 	data_available := make([]byte, 1)
 	if err := c.dev.ReadReg(status, data_available); err != nil {
-		log.Println("device is not available")
-		return c.data
+		return c.data, fmt.Errorf("device is not available: %v", err)
 	}
 	if (data_available[0] & (1 << 3)) > 0 {
 		result_data := make([]byte, 4)
 		if err := c.dev.ReadReg(alg_result_data, result_data); err != nil {
-			log.Println("ccs811 read data error")
-			return c.data
+			return c.data, fmt.Errorf("ccs811 read data error: %v", err)
 		}
-		c.data[conf.Co2MetricsName] = math.Min(8192.0, math.Max(400.0, float64((int16(result_data[0])<<8)|int16(result_data[1]))))
-		c.data[conf.VocMetricsName] = math.Min(1187.0, math.Max(0.0, float64((int16(result_data[2])<<8)|int16(result_data[3]))))
+		c.data[c.conf.Co2MetricsName] = math.Min(8192.0, math.Max(400.0, float64((int16(result_data[0])<<8)|int16(result_data[1]))))
+		c.data[c.conf.VocMetricsName] = math.Min(1187.0, math.Max(0.0, float64((int16(result_data[2])<<8)|int16(result_data[3]))))
 	}
 
-	return c.data
+	return c.data, nil
 }
 
 func (c *CCS811) GetConsoleHeader() string {
@@ -242,6 +424,6 @@ func (c *CCS811) GetConsoleHeader() string {
 }
 
 func (c *CCS811) GetConsoleData() string {
-	msg := fmt.Sprintf(" %9.2f | %9.2f ", c.data[conf.Co2MetricsName], c.data[conf.VocMetricsName])
+	msg := fmt.Sprintf(" %9.2f | %9.2f ", c.data[c.conf.Co2MetricsName], c.data[c.conf.VocMetricsName])
 	return msg
 }
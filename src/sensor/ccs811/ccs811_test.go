@@ -0,0 +1,218 @@
+package ccs811
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"sensor-exporter/bus/i2c"
+	"sensor-exporter/config"
+	"sensor-exporter/sensor"
+)
+
+// simCCS811 returns a device behaving like a CCS811 in boot mode with a
+// valid application, which switches to application mode on APP_START.
+func simCCS811() (*i2c.SimBus, *i2c.SimDevice) {
+	bus := i2c.NewSimBus()
+	dev := bus.AddDevice(0x5a)
+	dev.Set(hw_id, 0x81)
+	dev.Set(status, 1<<4) // APP_VALID
+	dev.OnWrite(app_start, func(d *i2c.SimDevice, data []byte) {
+		d.Set(status, 1<<7|1<<4|1<<3) // FW_MODE, APP_VALID, DATA_READY
+	})
+	// eCO2 450 ppm, TVOC 12 ppb
+	dev.SetMailbox(alg_result_data, 0x01, 0xC2, 0x00, 0x0C, 0x98, 0x00)
+	return bus, dev
+}
+
+func setConfig(t *testing.T, conf config.Ccs811) {
+	t.Helper()
+	conf.I2cAddress = 0x5a
+	conf.Co2MetricsName = "eco2"
+	conf.VocMetricsName = "tvoc"
+	conf.BaselineMetricsName = "baseline"
+	if conf.EnvMaxAge == 0 {
+		conf.EnvMaxAge = 5 * time.Minute
+	}
+	config.Set(config.Config{
+		Sensors: map[string]config.Sensor{"ccs811": {Name: "ccs811", PollInterval: 10 * time.Second}},
+		Ccs811:  map[string]config.Ccs811{"ccs811": conf},
+	})
+	t.Cleanup(func() { config.Set(config.Config{}) })
+}
+
+func TestInitSequence(t *testing.T) {
+	setConfig(t, config.Ccs811{})
+	bus, dev := simCCS811()
+	c := New("ccs811")
+	c.Bus = bus
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// APP_START without data, then the drive mode of a 10s poll interval
+	want := []i2c.SimWrite{
+		{Reg: app_start, Data: []byte{}},
+		{Reg: meas_mode, Data: []byte{mode_10sec << 4}},
+	}
+	writes := dev.Writes()
+	if len(writes) != len(want) {
+		t.Fatalf("writes = %v, want %v", writes, want)
+	}
+	for i := range want {
+		if writes[i].Reg != want[i].Reg || !bytes.Equal(writes[i].Data, want[i].Data) {
+			t.Errorf("write %d = %v, want %v", i, writes[i], want[i])
+		}
+	}
+	data, err := c.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["eco2"] != 450 || data["tvoc"] != 12 {
+		t.Errorf("Update = %v, want eco2 450 and tvoc 12", data)
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	setConfig(t, config.Ccs811{})
+	for _, tc := range []struct {
+		name  string
+		setup func(d *i2c.SimDevice)
+		want  string
+	}{
+		{"hardware id", func(d *i2c.SimDevice) { d.Set(hw_id, 0x55) }, "hardware id"},
+		{"no application", func(d *i2c.SimDevice) { d.Set(status, 0) }, "validation application error"},
+		{"heater supply", func(d *i2c.SimDevice) {
+			d.Set(status, 1<<4|1<<0)
+			d.Set(error_id, 1<<5)
+		}, "error: heater supply"},
+		{"invalid drive mode", func(d *i2c.SimDevice) {
+			d.OnWrite(meas_mode, func(d *i2c.SimDevice, data []byte) {
+				d.Set(status, 1<<7|1<<4|1<<0)
+				d.Set(error_id, 1<<2)
+			})
+		}, "error: meas mode invalid"},
+		{"read fault", func(d *i2c.SimDevice) { d.FailRead(hw_id, errors.New("nack")) }, "nack"},
+		{"write fault", func(d *i2c.SimDevice) { d.FailWrite(app_start, errors.New("nack")) }, "nack"},
+	} {
+		bus, dev := simCCS811()
+		tc.setup(dev)
+		c := New("ccs811")
+		c.Bus = bus
+		err := c.Init()
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: Init = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestUpdateFault(t *testing.T) {
+	setConfig(t, config.Ccs811{})
+	bus, dev := simCCS811()
+	c := New("ccs811")
+	c.Bus = bus
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	dev.SetFault(errors.New("bus error"))
+	if _, err := c.Update(); err == nil || !strings.Contains(err.Error(), "bus error") {
+		t.Errorf("Update = %v, want the bus error", err)
+	}
+	dev.SetFault(nil)
+	if _, err := c.Update(); err != nil {
+		t.Errorf("Update after the fault = %v", err)
+	}
+}
+
+func TestEnvData(t *testing.T) {
+	for _, tc := range []struct {
+		temp, humid float64
+		want        []byte
+	}{
+		// examples of the datasheet: 48.5 %RH and 25 °C
+		{25, 48.5, []byte{0x61, 0x00, 0x64, 0x00}},
+		{-25, 0, []byte{0x00, 0x00, 0x00, 0x00}},
+		{20.25, 50.5, []byte{0x65, 0x00, 0x5a, 0x80}},
+		// out of range values are clamped
+		{-40, 120, []byte{0xc8, 0x00, 0x00, 0x00}},
+		{80, -5, []byte{0x00, 0x00, 0xc8, 0x00}},
+	} {
+		if got := envData(tc.temp, tc.humid); !bytes.Equal(got, tc.want) {
+			t.Errorf("envData(%v, %v) = % x, want % x", tc.temp, tc.humid, got, tc.want)
+		}
+	}
+}
+
+func TestCompensate(t *testing.T) {
+	setConfig(t, config.Ccs811{EnvSource: "bme280.test"})
+	bus, dev := simCCS811()
+	c := New("ccs811")
+	c.Bus = bus
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	sensor.SetEnvironment("bme280.test", sensor.Environment{Temperature: 25, Humidity: 48.5, Time: time.Now()})
+	if _, err := c.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.Get(env_data, 4); !bytes.Equal(got, []byte{0x61, 0x00, 0x64, 0x00}) {
+		t.Errorf("ENV_DATA = % x", got)
+	}
+
+	dev.FailWrite(env_data, errors.New("nack"))
+	sensor.SetEnvironment("bme280.test", sensor.Environment{Temperature: 20, Humidity: 40, Time: time.Now()})
+	if _, err := c.Update(); err == nil {
+		t.Errorf("Update ignored the ENV_DATA write error")
+	}
+}
+
+func TestCompensateStale(t *testing.T) {
+	setConfig(t, config.Ccs811{EnvSource: "bme280.stale", EnvMaxAge: time.Minute})
+	bus, dev := simCCS811()
+	c := New("ccs811")
+	c.Bus = bus
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	envWrites := func() int {
+		n := 0
+		for _, w := range dev.Writes() {
+			if w.Reg == env_data {
+				n++
+			}
+		}
+		return n
+	}
+
+	sensor.SetEnvironment("bme280.stale", sensor.Environment{Temperature: 30, Humidity: 70, Time: time.Now()})
+	if _, err := c.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.Get(env_data, 4); !bytes.Equal(got, envData(30, 70)) {
+		t.Errorf("ENV_DATA = % x, want % x", got, envData(30, 70))
+	}
+
+	// the source stops updating: the defaults are written back once
+	sensor.SetEnvironment("bme280.stale", sensor.Environment{Temperature: 30, Humidity: 70, Time: time.Now().Add(-2 * time.Minute)})
+	for i := 0; i < 3; i++ {
+		if _, err := c.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := dev.Get(env_data, 4); !bytes.Equal(got, []byte{0x64, 0x00, 0x64, 0x00}) {
+		t.Errorf("ENV_DATA = % x, want the default 25 °C and 50 %%RH", got)
+	}
+	if n := envWrites(); n != 2 {
+		t.Errorf("ENV_DATA written %d times, want 2", n)
+	}
+
+	// and compensation resumes with the next reading
+	sensor.SetEnvironment("bme280.stale", sensor.Environment{Temperature: 21, Humidity: 45, Time: time.Now()})
+	if _, err := c.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.Get(env_data, 4); !bytes.Equal(got, envData(21, 45)) {
+		t.Errorf("ENV_DATA = % x, want % x", got, envData(21, 45))
+	}
+}
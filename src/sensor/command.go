@@ -0,0 +1,40 @@
+package sensor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Command is an administrative operation of a sensor, such as a
+// calibration. Commands change the state of the sensor, so they are only
+// run on request.
+type Command struct {
+	Name string
+	// Args describes the arguments, e.g. "<ppm>".
+	Args string
+	Help string
+	// Confirm tells the operator what to check before running the command.
+	Confirm string
+	Run     func(args []string) error
+}
+
+// Commander is implemented by sensors that offer administrative commands.
+type Commander interface {
+	Commands() []Command
+}
+
+// LookupCommand returns the command name of sensor s.
+func LookupCommand(s Sensor, name string) (Command, error) {
+	c, ok := s.(Commander)
+	if !ok {
+		return Command{}, fmt.Errorf("%s has no commands", s.GetInstanceName())
+	}
+	names := []string{}
+	for _, cmd := range c.Commands() {
+		if cmd.Name == name {
+			return cmd, nil
+		}
+		names = append(names, cmd.Name)
+	}
+	return Command{}, fmt.Errorf("unknown command %q of %s, one of %s", name, s.GetInstanceName(), strings.Join(names, ", "))
+}
@@ -0,0 +1,35 @@
+package sensor
+
+import (
+	"sync"
+	"time"
+)
+
+// Environment is an ambient temperature and humidity reading that drivers
+// share so that other sensors can compensate their measurements with it.
+type Environment struct {
+	Temperature float64 // [°C]
+	Humidity    float64 // [%RH]
+	Time        time.Time
+}
+
+var (
+	envMu        sync.RWMutex
+	environments = map[string]Environment{}
+)
+
+// SetEnvironment publishes the latest environment read by sensor instance.
+func SetEnvironment(instance string, env Environment) {
+	envMu.Lock()
+	defer envMu.Unlock()
+	environments[instance] = env
+}
+
+// GetEnvironment returns the latest environment published by sensor
+// instance, or false if it never published one.
+func GetEnvironment(instance string) (Environment, bool) {
+	envMu.RLock()
+	defer envMu.RUnlock()
+	env, ok := environments[instance]
+	return env, ok
+}
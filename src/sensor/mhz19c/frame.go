@@ -0,0 +1,83 @@
+package mhz19c
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// Frame layout: start byte, sensor number, command, 5 bytes of data and
+	// checksum. Responses carry the command in place of the sensor number.
+	frame_start  = byte(0xFF)
+	frame_sensor = byte(0x01)
+	frame_size   = 9
+
+	// Commands (from data sheet)
+	cmd_read_co2         = byte(0x86)
+	cmd_self_calibration = byte(0x79)
+	cmd_zero_calibration = byte(0x87)
+	cmd_span_calibration = byte(0x88)
+	cmd_detection_range  = byte(0x99)
+
+	// Bytes skipped looking for a frame header before giving up
+	max_resync_bytes = 2 * frame_size
+)
+
+var errBadChecksum = errors.New("bad checksum")
+
+// command returns the frame of cmd with up to 5 data bytes and its checksum.
+func command(cmd byte, data ...byte) []byte {
+	frame := make([]byte, frame_size)
+	frame[0] = frame_start
+	frame[1] = frame_sensor
+	frame[2] = cmd
+	copy(frame[3:8], data)
+	frame[8] = checksum(frame)
+	return frame
+}
+
+// checksum is 0xFF - (frame[1] + ... + frame[7]) + 1.
+func checksum(frame []byte) byte {
+	var sum byte
+	for _, b := range frame[1:8] {
+		sum += b
+	}
+	return 0xFF - sum + 1
+}
+
+// readFrame reads the response to cmd. Bytes before the 0xFF cmd header are
+// skipped to get back in sync after a lost or garbled byte. It also returns
+// the number of frames it rejected.
+func readFrame(r io.Reader, cmd byte) ([]byte, int, error) {
+	buf := make([]byte, frame_size)
+	rejected := 0
+	skipped := 0
+	n := 0
+	for {
+		if _, err := io.ReadFull(r, buf[n:]); err != nil {
+			return nil, rejected, err
+		}
+		aligned := buf[0] == frame_start && buf[1] == cmd
+		if aligned && checksum(buf) == buf[8] {
+			return buf, rejected, nil
+		}
+		if aligned || skipped == 0 {
+			rejected++
+		}
+
+		// look for the next header in the bytes read so far
+		i := 1
+		for i < frame_size && !(buf[i] == frame_start && (i == frame_size-1 || buf[i+1] == cmd)) {
+			i++
+		}
+		if aligned && i == frame_size {
+			return nil, rejected, errBadChecksum
+		}
+		skipped += i
+		if skipped > max_resync_bytes {
+			return nil, rejected, fmt.Errorf("no frame header in %d bytes", skipped)
+		}
+		n = copy(buf, buf[i:])
+	}
+}
@@ -1,80 +1,90 @@
 package mhz19c
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"sensor-exporter/bus/serial"
 	"sensor-exporter/config"
+	"sensor-exporter/sensor"
+	"strconv"
 	"time"
 
-	"github.com/tarm/serial"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
-	conf config.Mhz19c
+	// data for writing to get co2 data
+	read_co2_data = command(cmd_read_co2)
+	// data for writing to enable/disable zero point calibration
+	zero_point_calibration_on  = command(cmd_self_calibration, 0xA0)
+	zero_point_calibration_off = command(cmd_self_calibration, 0x00)
 
-	// data for writing to get co2 data (from data sheet)
-	read_co2_data = []byte{
-		0xFF,
-		0x01,
-		0x86,
-		0x00,
-		0x00,
-		0x00,
-		0x00,
-		0x00,
-		0x79,
-	}
-	// data for writing to enable zero point calibration (from data sheet)
-	// last byte is checksum: 0xFF - ([1]+[2]+...+[7]) + 0x01
-	zero_point_calibration_on = []byte{
-		0xFF,
-		0x01,
-		0x79,
-		0xA0,
-		0x00,
-		0x00,
-		0x00,
-		0x00,
-		0xE6,
-	}
-	// data for writing to disable zero point calibration (from data sheet)
-	// last byte is checksum: 0xFF - ([1]+[2]+...+[7]) + 0x01
-	zero_point_calibration_off = []byte{
-		0xFF,
-		0x01,
-		0x79,
-		0x00,
-		0x00,
-		0x00,
-		0x00,
-		0x00,
-		0x86,
-	}
+	// response frames rejected for a bad header or checksum, by sensor
+	rejected_frames = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mhz19c_rejected_frames_total",
+			Help: "Number of response frames from MH-Z19C rejected for a bad header or checksum",
+		},
+		[]string{"sensor_name", "sensor_instance"},
+	)
 )
 
+func init() {
+	sensor.Register(sensor.Driver{
+		Name:        "mhz19c",
+		Description: "Winsen MH-Z19C NDIR CO2 sensor on UART",
+		ConfigKeys: []sensor.ConfigKey{
+			{Name: "serial_port", Default: "/dev/serial0", Help: "serial port device"},
+			{Name: "serial_baudrate", Default: "9600", Help: "baud rate of the serial port", Kind: sensor.KindInt, Check: sensor.Positive},
+			{Name: "metrics_name_co2", Default: "co2", Help: "metrics name of the CO2 in [ppm]"},
+			{Name: "self_calibration", Default: "true", Help: "enable automatic baseline correction (ABC)", Kind: sensor.KindBool},
+		},
+		New:        func(name string) sensor.Sensor { return New(name) },
+		Collectors: []prometheus.Collector{rejected_frames},
+	})
+}
+
 type MHZ19C struct {
+	name string
+	conf config.Mhz19c
 	data map[string]float64
-	port *serial.Port
+	port serial.Port
+
+	// Opener is used to open the port. If nil, the port named by serial_port is used.
+	Opener serial.Opener
+}
+
+// New returns a driver for the sensor configured in section name.
+func New(name string) *MHZ19C {
+	return &MHZ19C{name: name, conf: config.GetConfig().Mhz19c[name]}
 }
 
 func (m *MHZ19C) Init() error {
-	conf = config.GetConfig().Mhz19c
-	log.Println("Open sensor MH-Z19C")
+	m.conf = config.GetConfig().Mhz19c[m.name]
+	log.Printf("Open sensor MH-Z19C (%s)\n", m.name)
 
 	// setup serial port
-	c := &serial.Config{Name: conf.SerialPort, Baud: conf.SerialBaudrate, ReadTimeout: time.Millisecond * 500}
-	port, err := serial.OpenPort(c)
+	var port serial.Port
+	var err error
+	if m.Opener != nil {
+		port, err = m.Opener(m.conf.SerialBaudrate, time.Millisecond*500)
+	} else {
+		port, err = serial.Open(m.conf.SerialPort, m.conf.SerialBaudrate, time.Millisecond*500)
+	}
 	if err != nil {
 		return err
 	}
 	m.port = port
 
 	// set auto calibration
-	if conf.SelfCalibration {
-		m.port.Write(zero_point_calibration_on)
-	} else {
-		m.port.Write(zero_point_calibration_off)
+	abc := zero_point_calibration_off
+	if m.conf.SelfCalibration {
+		abc = zero_point_calibration_on
+	}
+	if _, err := m.port.Write(abc); err != nil {
+		return err
 	}
 
 	// read existing data before start application
@@ -90,39 +100,152 @@ func (m *MHZ19C) Init() error {
 
 	// init data array
 	m.data = map[string]float64{
-		conf.Co2MetricsName: 0.0,
+		m.conf.Co2MetricsName: 0.0,
 	}
+	rejected_frames.WithLabelValues(m.GetSensorName(), m.name)
 
 	return nil
 }
 
 func (m *MHZ19C) Close() {
-	log.Println("Close sensor MH-Z19C")
+	if m.port == nil {
+		return
+	}
+	log.Printf("Close sensor MH-Z19C (%s)\n", m.name)
 	m.port.Close()
+	m.port = nil
 }
 
 func (m *MHZ19C) GetSensorName() string {
 	return "MH-Z19C"
 }
 
+func (m *MHZ19C) GetInstanceName() string {
+	return m.name
+}
+
 func (m *MHZ19C) GetMetricsDescriptions() map[string]string {
 	return map[string]string{
-		conf.Co2MetricsName: "CO2 value in [ppm] measured by MH-Z19C",
+		m.conf.Co2MetricsName: "CO2 value in [ppm] measured by MH-Z19C",
 	}
 }
 
-func (m *MHZ19C) Update() map[string]float64 {
-	buf := make([]byte, 9)
-	_, werr := m.port.Write(read_co2_data)
-	_, rerr := m.port.Read(buf)
-	if werr != nil || rerr != nil {
-		log.Printf("MH-Z19C data update error")
-		return m.data
+func (m *MHZ19C) Update() (map[string]float64, error) {
+	if _, err := m.port.Write(read_co2_data); err != nil {
+		return m.data, fmt.Errorf("MH-Z19C write error: %v", err)
+	}
+	buf, err := m.readResponse(cmd_read_co2)
+	if err != nil {
+		return m.data, fmt.Errorf("MH-Z19C read error: %v", err)
 	}
 	value := int(buf[2])<<8 | int(buf[3])
-	m.data[conf.Co2MetricsName] = math.Min(10000.0, math.Max(400.0, float64(value)))
+	m.data[m.conf.Co2MetricsName] = math.Min(10000.0, math.Max(400.0, float64(value)))
+
+	return m.data, nil
+}
+
+func (m *MHZ19C) Commands() []sensor.Command {
+	return []sensor.Command{
+		{
+			Name:    "calibrate-zero",
+			Help:    "take the current concentration as 400 ppm",
+			Confirm: "the sensor must have been in fresh air (about 400 ppm) for at least 20 minutes",
+			Run: func(args []string) error {
+				if len(args) != 0 {
+					return errors.New("calibrate-zero takes no arguments")
+				}
+				return m.CalibrateZero()
+			},
+		},
+		{
+			Name:    "calibrate-span",
+			Args:    "<ppm>",
+			Help:    "take the current concentration as <ppm>",
+			Confirm: "calibrate the zero point first, and keep the sensor in gas of the given concentration for at least 20 minutes",
+			Run: func(args []string) error {
+				ppm, err := ppmArg(args)
+				if err != nil {
+					return err
+				}
+				return m.CalibrateSpan(ppm)
+			},
+		},
+		{
+			Name:    "set-range",
+			Args:    "<ppm>",
+			Help:    "set the detection range to 2000, 5000 or 10000 ppm",
+			Confirm: "readings above the new range are cut off",
+			Run: func(args []string) error {
+				ppm, err := ppmArg(args)
+				if err != nil {
+					return err
+				}
+				return m.SetRange(ppm)
+			},
+		},
+	}
+}
 
-	return m.data
+func ppmArg(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, errors.New("expected one argument <ppm>")
+	}
+	ppm, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid ppm %q", args[0])
+	}
+	return ppm, nil
+}
+
+// CalibrateZero sets the current concentration as the 400 ppm zero point.
+func (m *MHZ19C) CalibrateZero() error {
+	log.Printf("%s: calibrate zero point\n", m.name)
+	return m.write(command(cmd_zero_calibration))
+}
+
+// CalibrateSpan sets the current concentration as the span point ppm.
+func (m *MHZ19C) CalibrateSpan(ppm int) error {
+	if ppm < 1000 || ppm > 10000 {
+		return fmt.Errorf("span point %d ppm is out of range [1000, 10000]", ppm)
+	}
+	log.Printf("%s: calibrate span point to %d ppm\n", m.name, ppm)
+	return m.write(command(cmd_span_calibration, byte(ppm>>8), byte(ppm)))
+}
+
+// SetRange sets the detection range of the sensor.
+func (m *MHZ19C) SetRange(ppm int) error {
+	if ppm != 2000 && ppm != 5000 && ppm != 10000 {
+		return fmt.Errorf("detection range %d ppm is not one of 2000, 5000, 10000", ppm)
+	}
+	log.Printf("%s: set detection range to %d ppm\n", m.name, ppm)
+	if err := m.write(command(cmd_detection_range, 0x00, 0x00, 0x00, byte(ppm>>8), byte(ppm))); err != nil {
+		return err
+	}
+	// read the acknowledgement, which the next read would reject otherwise
+	if _, err := m.readResponse(cmd_detection_range); err != nil {
+		return fmt.Errorf("MH-Z19C detection range not acknowledged: %v", err)
+	}
+	return nil
+}
+
+// readResponse reads the response to cmd, counting the frames rejected
+// whether or not a frame was read in the end.
+func (m *MHZ19C) readResponse(cmd byte) ([]byte, error) {
+	buf, rejected, err := readFrame(m.port, cmd)
+	if rejected > 0 {
+		rejected_frames.WithLabelValues(m.GetSensorName(), m.name).Add(float64(rejected))
+	}
+	return buf, err
+}
+
+func (m *MHZ19C) write(frame []byte) error {
+	if m.port == nil {
+		return errors.New("MH-Z19C is not open")
+	}
+	if _, err := m.port.Write(frame); err != nil {
+		return fmt.Errorf("MH-Z19C write error: %v", err)
+	}
+	return nil
 }
 
 func (m *MHZ19C) GetConsoleHeader() string {
@@ -130,6 +253,6 @@ func (m *MHZ19C) GetConsoleHeader() string {
 }
 
 func (m *MHZ19C) GetConsoleData() string {
-	msg := fmt.Sprintf(" %8.2f ", m.data[conf.Co2MetricsName])
+	msg := fmt.Sprintf(" %8.2f ", m.data[m.conf.Co2MetricsName])
 	return msg
 }
@@ -0,0 +1,244 @@
+package mhz19c
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"sensor-exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func frame(b ...byte) []byte {
+	f := append([]byte{}, b...)
+	f[8] = checksum(f)
+	return f
+}
+
+func TestCommandFrames(t *testing.T) {
+	// frames of the datasheet
+	for _, tc := range []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{"read", read_co2_data, []byte{0xFF, 0x01, 0x86, 0x00, 0x00, 0x00, 0x00, 0x00, 0x79}},
+		{"abc on", zero_point_calibration_on, []byte{0xFF, 0x01, 0x79, 0xA0, 0x00, 0x00, 0x00, 0x00, 0xE6}},
+		{"abc off", zero_point_calibration_off, []byte{0xFF, 0x01, 0x79, 0x00, 0x00, 0x00, 0x00, 0x00, 0x86}},
+		{"zero", command(cmd_zero_calibration), []byte{0xFF, 0x01, 0x87, 0x00, 0x00, 0x00, 0x00, 0x00, 0x78}},
+		{"span 2000", command(cmd_span_calibration, 0x07, 0xD0), []byte{0xFF, 0x01, 0x88, 0x07, 0xD0, 0x00, 0x00, 0x00, 0xA0}},
+		{"range 2000", command(cmd_detection_range, 0x00, 0x00, 0x00, 0x07, 0xD0), []byte{0xFF, 0x01, 0x99, 0x00, 0x00, 0x00, 0x07, 0xD0, 0x8F}},
+	} {
+		if !bytes.Equal(tc.got, tc.want) {
+			t.Errorf("%s = % X, want % X", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	good := frame(0xFF, 0x86, 0x02, 0x60, 0x47, 0x00, 0x00, 0x00, 0x00)
+	bad := append([]byte{}, good...)
+	bad[8]++
+	for _, tc := range []struct {
+		name     string
+		in       []byte
+		rejected int
+		err      string
+	}{
+		{"aligned", good, 0, ""},
+		{"garbage before", append([]byte{0x00, 0x12, 0xFF}, good...), 1, ""},
+		{"header of another command", append([]byte{0xFF, 0x79}, good...), 1, ""},
+		// a false header is rejected as well before the real one is found
+		{"header in the garbage", append([]byte{0x00, 0xFF, 0x86, 0xFF}, good...), 2, ""},
+		{"bad checksum", bad, 1, "bad checksum"},
+		{"bad checksum then a frame", append(bad[:7:7], good...), 1, ""},
+		{"partial frame", good[:5], 0, io.ErrUnexpectedEOF.Error()},
+		{"no data", nil, 0, io.EOF.Error()},
+		{"no header", bytes.Repeat([]byte{0x55}, 40), 1, "no frame header"},
+	} {
+		buf, rejected, err := readFrame(bytes.NewReader(tc.in), cmd_read_co2)
+		if tc.err == "" {
+			if err != nil || !bytes.Equal(buf, good) {
+				t.Errorf("%s: readFrame = % X, %v, want % X", tc.name, buf, err, good)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: readFrame error = %v, want %q", tc.name, err, tc.err)
+		}
+		if rejected != tc.rejected {
+			t.Errorf("%s: rejected %d frames, want %d", tc.name, rejected, tc.rejected)
+		}
+	}
+}
+
+// openSim returns a driver reading sim with a short read timeout, without
+// the draining of Init.
+func openSim(t *testing.T, sim *Simulator) *MHZ19C {
+	t.Helper()
+	port, err := sim.Open(9600, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &MHZ19C{
+		name: "mhz19c",
+		conf: config.Mhz19c{Co2MetricsName: "co2"},
+		port: port,
+	}
+	m.data = map[string]float64{"co2": 0}
+	return m
+}
+
+func TestUpdateFaults(t *testing.T) {
+	sim := NewSimulator()
+	m := openSim(t, sim)
+	read := func(want int) {
+		t.Helper()
+		data, err := m.Update()
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if data["co2"] != float64(want) {
+			t.Errorf("co2 = %v, want %d", data["co2"], want)
+		}
+	}
+	fail := func(want string) {
+		t.Helper()
+		if _, err := m.Update(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Update = %v, want %q", err, want)
+		}
+	}
+
+	rejected := func(want float64) {
+		t.Helper()
+		if n := testutil.ToFloat64(rejected_frames.WithLabelValues("MH-Z19C", "mhz19c")); n != want {
+			t.Errorf("%v rejected frames, want %v", n, want)
+		}
+	}
+	rejected_frames.Reset()
+
+	sim.SetCO2(612)
+	read(612)
+	rejected(0)
+
+	sim.InjectGarbage(0x00, 0xFF, 0x13)
+	sim.SetCO2(700)
+	read(700)
+	rejected(1)
+
+	// counted although the read fails
+	sim.CorruptNext()
+	fail("bad checksum")
+	read(700)
+	rejected(2)
+	if data, _ := m.Update(); len(data) != 1 {
+		t.Errorf("readings = %v, want only co2", data)
+	}
+
+	sim.TruncateNext(5)
+	fail("unexpected EOF")
+	read(700)
+
+	sim.DropResponses(1)
+	fail("EOF")
+	read(700)
+
+	sim.SetDelay(200 * time.Millisecond)
+	fail("EOF")
+	sim.SetDelay(0)
+
+	if n := sim.BadFrames(); n != 0 {
+		t.Errorf("simulator received %d bad frames", n)
+	}
+}
+
+func TestCalibrationCommands(t *testing.T) {
+	sim := NewSimulator()
+	m := openSim(t, sim)
+	rejected_frames.Reset()
+
+	if err := m.SetRange(2000); err != nil {
+		t.Fatal(err)
+	}
+	// the acknowledgement is read by SetRange, not rejected by the next read
+	if _, err := m.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(rejected_frames.WithLabelValues("MH-Z19C", "mhz19c")); n != 0 {
+		t.Errorf("%v rejected frames after SetRange", n)
+	}
+	if err := m.CalibrateSpan(2000); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CalibrateZero(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{
+		{0xFF, 0x01, 0x99, 0x00, 0x00, 0x00, 0x07, 0xD0, 0x8F},
+		{0xFF, 0x01, 0x86, 0x00, 0x00, 0x00, 0x00, 0x00, 0x79},
+		{0xFF, 0x01, 0x88, 0x07, 0xD0, 0x00, 0x00, 0x00, 0xA0},
+		{0xFF, 0x01, 0x87, 0x00, 0x00, 0x00, 0x00, 0x00, 0x78},
+	}
+	got := sim.Commands()
+	if len(got) != len(want) {
+		t.Fatalf("commands = % X, want % X", got, want)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("command %d = % X, want % X", i, got[i], want[i])
+		}
+	}
+	if sim.DetectionRange() != 2000 || sim.CO2() != 400 {
+		t.Errorf("simulator range %d, co2 %d after the commands", sim.DetectionRange(), sim.CO2())
+	}
+
+	// out of range values are not sent
+	for _, err := range []error{m.SetRange(3000), m.CalibrateSpan(500), m.CalibrateSpan(20000)} {
+		if err == nil {
+			t.Errorf("out of range command accepted")
+		}
+	}
+	if n := len(sim.Commands()); n != len(want) {
+		t.Errorf("%d commands sent, want %d", n, len(want))
+	}
+
+	// commands are parsed from the CLI and admin arguments
+	for _, cmd := range m.Commands() {
+		if cmd.Name == "set-range" {
+			if err := cmd.Run([]string{"10000"}); err != nil || sim.DetectionRange() != 10000 {
+				t.Errorf("set-range 10000 = %v, range %d", err, sim.DetectionRange())
+			}
+			if err := cmd.Run([]string{"lots"}); err == nil {
+				t.Errorf("set-range lots accepted")
+			}
+			sim.DropResponses(1)
+			if err := cmd.Run([]string{"2000"}); err == nil || !strings.Contains(err.Error(), "not acknowledged") {
+				t.Errorf("set-range without acknowledgement = %v", err)
+			}
+		}
+	}
+
+	m.Close()
+	if err := m.CalibrateZero(); err == nil {
+		t.Errorf("command sent to a closed sensor")
+	}
+}
+
+func TestInitSetsSelfCalibration(t *testing.T) {
+	sim := NewSimulator()
+	config.Set(config.Config{Mhz19c: map[string]config.Mhz19c{"mhz19c": {Co2MetricsName: "co2", SelfCalibration: false}}})
+	defer config.Set(config.Config{})
+	m := New("mhz19c")
+	m.Opener = sim.Open
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if sim.SelfCalibration() {
+		t.Errorf("ABC still on")
+	}
+	if cmds := sim.Commands(); len(cmds) != 1 || !bytes.Equal(cmds[0], zero_point_calibration_off) {
+		t.Errorf("commands = % X, want ABC off", cmds)
+	}
+}
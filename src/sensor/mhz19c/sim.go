@@ -0,0 +1,267 @@
+package mhz19c
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"sensor-exporter/bus/serial"
+)
+
+// Simulator is an in-process MH-Z19C that speaks the 9 byte UART protocol.
+// Its Open method is a serial.Opener, so it can be handed to the driver
+// directly or registered with serial.Register under a port name.
+type Simulator struct {
+	mu             sync.Mutex
+	co2            int
+	temperature    int
+	abc            bool
+	detectionRange int
+	readTimeout    time.Duration
+	closed         bool
+	in             []byte
+	out            []byte
+	commands       [][]byte
+	badFrames      int
+
+	// fault injection
+	dropResponses int
+	garbage       []byte
+	truncate      int
+	corrupt       bool
+	delay         time.Duration
+}
+
+func NewSimulator() *Simulator {
+	return &Simulator{
+		co2:            400,
+		temperature:    25,
+		abc:            true,
+		detectionRange: 5000,
+		readTimeout:    500 * time.Millisecond,
+		truncate:       -1,
+	}
+}
+
+func (s *Simulator) Open(baud int, readTimeout time.Duration) (serial.Port, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readTimeout = readTimeout
+	s.closed = false
+	s.in = nil
+	s.out = nil
+	return s, nil
+}
+
+// SetCO2 sets the concentration in [ppm] reported by the next read command.
+func (s *Simulator) SetCO2(ppm int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.co2 = ppm
+}
+
+// SetTemperature sets the temperature in [°C] reported in read responses.
+func (s *Simulator) SetTemperature(celsius int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.temperature = celsius
+}
+
+func (s *Simulator) CO2() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.co2
+}
+
+// SelfCalibration reports whether ABC was last switched on.
+func (s *Simulator) SelfCalibration() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.abc
+}
+
+func (s *Simulator) DetectionRange() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.detectionRange
+}
+
+// Commands returns every well-formed command frame received so far.
+func (s *Simulator) Commands() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte{}, s.commands...)
+}
+
+// BadFrames returns how many received frames had a bad checksum.
+func (s *Simulator) BadFrames() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.badFrames
+}
+
+// DropResponses makes the simulator ignore the next n read or detection
+// range commands, so the driver sees read timeouts.
+func (s *Simulator) DropResponses(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropResponses = n
+}
+
+// InjectGarbage queues bytes that are sent before the next response.
+func (s *Simulator) InjectGarbage(b ...byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.garbage = append(s.garbage, b...)
+}
+
+// TruncateNext cuts the next response to n bytes.
+func (s *Simulator) TruncateNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.truncate = n
+}
+
+// CorruptNext sends the next response with a wrong checksum.
+func (s *Simulator) CorruptNext() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.corrupt = true
+}
+
+// SetDelay delays every response by d, which exceeds the read timeout of the
+// driver if d is long enough.
+func (s *Simulator) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+func (s *Simulator) Write(buf []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, errors.New("mhz19c simulator: port is closed")
+	}
+	s.in = append(s.in, buf...)
+	for {
+		// skip to the start byte of the next frame
+		for len(s.in) > 0 && s.in[0] != 0xFF {
+			s.in = s.in[1:]
+		}
+		if len(s.in) < 9 {
+			break
+		}
+		frame := append([]byte{}, s.in[:9]...)
+		s.in = s.in[9:]
+		if checksum(frame) != frame[8] {
+			s.badFrames++
+			continue
+		}
+		s.commands = append(s.commands, frame)
+		s.handle(frame)
+	}
+
+	return len(buf), nil
+}
+
+func (s *Simulator) handle(frame []byte) {
+	switch frame[2] {
+	case 0x86: // read co2
+		if s.dropResponses > 0 {
+			s.dropResponses--
+			return
+		}
+		co2 := s.co2
+		if co2 > s.detectionRange {
+			co2 = s.detectionRange
+		}
+		resp := []byte{0xFF, 0x86, byte(co2 >> 8), byte(co2), byte(s.temperature + 40), 0x00, 0x00, 0x00, 0x00}
+		resp[8] = checksum(resp)
+		if s.corrupt {
+			resp[8]++
+			s.corrupt = false
+		}
+		s.respond(resp)
+	case 0x79: // self calibration on/off
+		s.abc = frame[3] == 0xA0
+	case 0x87: // zero point calibration
+		s.co2 = 400
+	case 0x88: // span point calibration
+		s.co2 = int(frame[3])<<8 | int(frame[4])
+	case 0x99: // detection range, acknowledged
+		if s.dropResponses > 0 {
+			s.dropResponses--
+			return
+		}
+		s.detectionRange = int(frame[6])<<8 | int(frame[7])
+		resp := []byte{0xFF, 0x99, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+		resp[8] = checksum(resp)
+		s.respond(resp)
+	}
+}
+
+// respond must be called with the lock held.
+func (s *Simulator) respond(resp []byte) {
+	out := append(s.garbage, resp...)
+	if s.truncate >= 0 && s.truncate < len(resp) {
+		out = out[:len(s.garbage)+s.truncate]
+	}
+	s.garbage = nil
+	s.truncate = -1
+	if s.delay <= 0 {
+		s.out = append(s.out, out...)
+		return
+	}
+	time.AfterFunc(s.delay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.closed {
+			s.out = append(s.out, out...)
+		}
+	})
+}
+
+func (s *Simulator) Read(buf []byte) (int, error) {
+	deadline := time.Now().Add(s.timeout())
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return 0, errors.New("mhz19c simulator: port is closed")
+		}
+		if len(s.out) > 0 {
+			n := copy(buf, s.out)
+			s.out = s.out[n:]
+			s.mu.Unlock()
+			return n, nil
+		}
+		s.mu.Unlock()
+		if !time.Now().Before(deadline) {
+			return 0, io.EOF
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *Simulator) timeout() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readTimeout
+}
+
+func (s *Simulator) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.in = nil
+	s.out = nil
+	return nil
+}
+
+func (s *Simulator) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
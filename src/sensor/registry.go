@@ -0,0 +1,227 @@
+package sensor
+
+import (
+	"fmt"
+	"sensor-exporter/pipeline"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of config values, used to validate config files.
+const (
+	KindString   = "string"
+	KindInt      = "int"
+	KindFloat    = "float"
+	KindBool     = "bool"
+	KindDuration = "duration"
+	// KindSensor names another enabled sensor section.
+	KindSensor = "sensor"
+)
+
+// ConfigKey describes a key accepted in the config section of a driver.
+type ConfigKey struct {
+	Name    string
+	Default string
+	Help    string
+	// Kind is one of the Kind constants, KindString if empty.
+	Kind string
+	// Check optionally validates the value beyond its kind.
+	Check func(value string) error
+	// Prefix marks keys named Name followed by a metrics name, e.g.
+	// offset_temperature.
+	Prefix bool
+}
+
+// CheckValue validates value against the kind and the check of the key.
+func (k ConfigKey) CheckValue(value string) error {
+	var err error
+	switch k.Kind {
+	case KindInt:
+		_, err = strconv.ParseInt(value, 0, 64)
+	case KindFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case KindBool:
+		_, err = parseBool(value)
+	case KindDuration:
+		_, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a valid %s", value, k.Kind)
+	}
+	if k.Check != nil {
+		return k.Check(value)
+	}
+	return nil
+}
+
+// parseBool accepts the same values as the ini package.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, nil
+	case "0", "f", "false", "n", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid bool %q", value)
+}
+
+// OneOf returns a check accepting only the given values.
+func OneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(values, ", "))
+	}
+}
+
+// IntOneOf returns a check accepting only the given integers.
+func IntOneOf(values ...int64) func(string) error {
+	return func(value string) error {
+		v, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		list := []string{}
+		for _, allowed := range values {
+			if v == allowed {
+				return nil
+			}
+			list = append(list, fmt.Sprintf("0x%x", allowed))
+		}
+		return fmt.Errorf("%s is not one of %s", value, strings.Join(list, ", "))
+	}
+}
+
+// IntRange returns a check accepting integers from min to max.
+func IntRange(min, max int64) func(string) error {
+	return func(value string) error {
+		v, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		if v < min || v > max {
+			return fmt.Errorf("%s is out of range [%d, %d]", value, min, max)
+		}
+		return nil
+	}
+}
+
+// FloatRange returns a check accepting numbers from min to max.
+func FloatRange(min, max float64) func(string) error {
+	return func(value string) error {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if v < min || v > max {
+			return fmt.Errorf("%s is out of range [%v, %v]", value, min, max)
+		}
+		return nil
+	}
+}
+
+// Positive is a check accepting durations and numbers greater than zero.
+func Positive(value string) error {
+	if d, err := time.ParseDuration(value); err == nil {
+		if d <= 0 {
+			return fmt.Errorf("%s must be greater than zero", value)
+		}
+		return nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && f <= 0 {
+		return fmt.Errorf("%s must be greater than zero", value)
+	}
+	return nil
+}
+
+// DurationOneOf returns a check accepting only the given durations.
+func DurationOneOf(values ...time.Duration) func(string) error {
+	return func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		list := []string{}
+		for _, allowed := range values {
+			if d == allowed {
+				return nil
+			}
+			list = append(list, allowed.String())
+		}
+		return fmt.Errorf("%s is not one of %s", value, strings.Join(list, ", "))
+	}
+}
+
+// Driver describes a sensor driver that can be named in enable_sensor.
+type Driver struct {
+	Name        string
+	Description string
+	ConfigKeys  []ConfigKey
+	// New returns a sensor configured by the section with the given name,
+	// e.g. "bme280" or "bme280.outdoor".
+	New func(name string) Sensor
+	// Collectors are metrics of the driver itself rather than readings,
+	// such as counters, registered with the exporter.
+	Collectors []prometheus.Collector
+}
+
+// CommonConfigKeys are accepted in the section of every driver.
+var CommonConfigKeys = []ConfigKey{
+	{Name: "poll_interval", Default: "1s", Help: "interval between two reads of the sensor", Kind: KindDuration, Check: Positive},
+	{Name: "offset_", Default: "0", Help: "added to the metrics after scale", Kind: KindFloat, Prefix: true},
+	{Name: "scale_", Default: "1", Help: "multiplies the metrics before offset", Kind: KindFloat, Prefix: true},
+	{Name: "correction_", Default: "", Help: "piecewise linear correction table raw:value, raw:value, ... applied before scale", Check: pipeline.CheckTable, Prefix: true},
+	{Name: "max_rate_", Default: "", Help: "reject values changing faster than this per second, unless the change persists for 3 reads", Kind: KindFloat, Check: Positive, Prefix: true},
+	{Name: "smooth_", Default: "", Help: "smoothing filter sma:<n>, ema:<alpha> or median:<n>, applied after correction", Check: pipeline.CheckSmoother, Prefix: true},
+	{Name: "export_raw", Default: "false", Help: "also export corrected metrics before correction as <metrics>_raw", Kind: KindBool},
+}
+
+var (
+	driversMu sync.Mutex
+	drivers   = map[string]Driver{}
+)
+
+// Register makes a driver available by its name. It is meant to be called
+// from the init function of the driver package, and panics if the name is
+// already taken.
+func Register(d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if d.New == nil {
+		panic("sensor: Register driver " + d.Name + " without constructor")
+	}
+	if _, dup := drivers[d.Name]; dup {
+		panic("sensor: Register called twice for driver " + d.Name)
+	}
+	drivers[d.Name] = d
+}
+
+// Drivers returns the registered drivers sorted by name.
+func Drivers() []Driver {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	list := make([]Driver, 0, len(drivers))
+	for _, d := range drivers {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func LookupDriver(name string) (Driver, error) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	d, ok := drivers[name]
+	if !ok {
+		return Driver{}, fmt.Errorf("unknown sensor driver %q", name)
+	}
+	return d, nil
+}
@@ -1,47 +1,65 @@
 package sensor
 
 import (
-	"sensor-exporter/sensor/bme280"
-	"sensor-exporter/sensor/ccs811"
-	"sensor-exporter/sensor/mhz19c"
+	"fmt"
+	"sensor-exporter/config"
+	"time"
 )
 
 type Sensor interface {
 	Init() error
 	GetSensorName() string
+	GetInstanceName() string
 	GetMetricsDescriptions() map[string]string
-	Update() map[string]float64
+	Update() (map[string]float64, error)
 	GetConsoleHeader() string
 	GetConsoleData() string
 	Close()
 }
 
-var (
-	sensors = []Sensor{}
-)
+// Deriver is implemented by sensors computing metrics from their other
+// metrics, e.g. a dew point from the temperature and the humidity.
+type Deriver interface {
+	// Derive adds the derived metrics to data, a reading whose metrics
+	// were corrected since Update returned it. t is the time of the reading.
+	Derive(data map[string]float64, t time.Time)
+}
 
-func Init(enabledSensors []string) []Sensor {
-	//sensors = make([]Sensor, len(enabledSensors))
-	for _, s := range enabledSensors {
-		if s == "bme280" {
-			sensors = append(sensors, &bme280.BME280{})
-		}
-		if s == "ccs811" {
-			sensors = append(sensors, &ccs811.CCS811{})
-		}
-		if s == "mhz19c" {
-			sensors = append(sensors, &mhz19c.MHZ19C{})
+// ChipInfo is implemented by sensors that identify their chip in Init.
+type ChipInfo interface {
+	// Chip returns the name and the id of the chip.
+	Chip() (string, string)
+}
+
+func Init(enabledSensors []string) ([]Sensor, error) {
+	sensors := []Sensor{}
+	for _, name := range enabledSensors {
+		s, err := New(name)
+		if err != nil {
+			return nil, err
 		}
+		sensors = append(sensors, s)
 	}
 
-	return sensors
+	return sensors, nil
+}
+
+// New returns a sensor for the section name using the registered driver.
+func New(name string) (Sensor, error) {
+	driver, err := LookupDriver(config.SensorType(name))
+	if err != nil {
+		return nil, fmt.Errorf("enable_sensor %s: %v", name, err)
+	}
+	return driver.New(name), nil
 }
 
-func GetDescriptions(enabledMetrics []string) map[string]string {
+// GetDescriptions returns the descriptions of the enabled metrics, given the
+// metrics descriptions of every sensor.
+func GetDescriptions(descriptions []map[string]string, enabledMetrics []string) map[string]string {
 	desc := make(map[string]string, len(enabledMetrics))
 	for _, metrics := range enabledMetrics {
-		for _, s := range sensors {
-			for i, metricsDescription := range s.GetMetricsDescriptions() {
+		for _, d := range descriptions {
+			for i, metricsDescription := range d {
 				if metrics == i {
 					desc[metrics] = metricsDescription
 				}